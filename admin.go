@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// NewAdminServer creates the admin API http server
+func (app *App) NewAdminServer() *mux.Router {
+	r := mux.NewRouter()
+
+	// Kubernetes probes, not logged
+	r.HandleFunc("/healthz", app.healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", app.readyzHandler).Methods("GET")
+
+	r.Handle("/certificate", adminHandler(app.adminCertificateHandler)).Methods("GET")
+
+	ni := r.PathPrefix("/network-interfaces").Subrouter()
+	ni.Handle("", adminHandler(app.adminNetworkInterfacesHandler)).Methods("GET")
+	ni.Handle("/{mac}", adminHandler(app.adminNetworkInterfaceHandler)).Methods("GET")
+	ni.Handle("/{mac}/ipv4-associations/{ip}", adminHandler(app.adminAssociateAddressHandler)).Methods("PUT")
+	ni.Handle("/{mac}/ipv4-associations/{ip}", adminHandler(app.adminDisassociateAddressHandler)).Methods("DELETE")
+
+	bdm := r.PathPrefix("/block-device-mappings").Subrouter()
+	bdm.Handle("", adminHandler(app.adminBlockDeviceMappingsHandler)).Methods("GET")
+	bdm.Handle("/{name}", adminHandler(app.adminAttachVolumeHandler)).Methods("PUT")
+	bdm.Handle("/{name}", adminHandler(app.adminDetachVolumeHandler)).Methods("DELETE")
+
+	r.Handle("/metadata-options", adminHandler(app.adminMetadataOptionsHandler)).Methods("GET")
+	r.Handle("/metadata-options", adminHandler(app.adminModifyMetadataOptionsHandler)).Methods("PUT")
+
+	r.Handle("/rate-limits", adminHandler(app.adminRateLimitsHandler)).Methods("GET")
+	r.Handle("/rate-limits", adminHandler(app.adminModifyRateLimitsHandler)).Methods("PUT")
+	r.Handle("/rate-limits/clients", adminHandler(app.adminResetRateLimitsHandler)).Methods("DELETE")
+
+	r.Handle("/faults", adminHandler(app.adminFaultsHandler)).Methods("GET")
+	r.Handle("/faults", adminHandler(app.adminAddFaultHandler)).Methods("POST")
+	r.Handle("/faults", adminHandler(app.adminRemoveFaultHandler)).Methods("DELETE")
+	r.Handle("/faults/{id:[0-9]+}", adminHandler(app.adminRemoveFaultHandler)).Methods("DELETE")
+
+	r.Handle("/scenario", adminHandler(app.adminScenarioHandler)).Methods("GET")
+
+	r.Handle("/journal", adminHandler(app.adminJournalHandler)).Methods("GET")
+	r.Handle("/journal", adminHandler(app.adminResetJournalHandler)).Methods("DELETE")
+
+	r.Handle("/metrics", adminHandler(app.adminMetricsHandler)).Methods("GET")
+
+	r.Handle("/clock", adminHandler(app.adminClockHandler)).Methods("GET")
+	r.Handle("/clock", adminHandler(app.adminModifyClockHandler)).Methods("PUT")
+	r.Handle("/clock", adminHandler(app.adminResetClockHandler)).Methods("DELETE")
+
+	return r
+}
+
+// readLocked holds the read lock for the duration of each request, so changes made
+// through the admin API are never seen half applied. Work that shouldn't hold the lock,
+// such as calling STS, is left by the handler with serveUnlocked to run once it's released.
+func (app *App) readLocked(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var unlocked http.Handler
+		func() {
+			app.mu.RLock()
+			defer app.mu.RUnlock()
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), unlockedKey{}, &unlocked)))
+		}()
+		if unlocked != nil {
+			unlocked.ServeHTTP(w, r)
+		}
+	})
+}
+
+type unlockedKey struct{}
+
+// serveUnlocked has h serve the request once readLocked has released the read lock, or straight away
+// for a request that didn't go through readLocked. h must only use what the handler passes it, and
+// App state that has a lock of its own.
+func serveUnlocked(w http.ResponseWriter, r *http.Request, h http.Handler) {
+	if unlocked, ok := r.Context().Value(unlockedKey{}).(*http.Handler); ok {
+		*unlocked = h
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+type adminHandler func(http.ResponseWriter, *http.Request)
+
+func (fn adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Infof("Admin %s %s", r.Method, r.RequestURI)
+	fn(w, r)
+}
+
+// The PEM certificate instance identity documents are signed with, to verify them against
+func (app *App) adminCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(app.identitySigner.certificatePEM())
+}
+
+func (app *App) adminNetworkInterfacesHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	writeJSON(w, app.NetworkInterfaces)
+}
+
+func (app *App) adminNetworkInterfaceHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	eni := app.networkInterface(mux.Vars(r)["mac"])
+	if eni == nil {
+		http.Error(w, "network interface not found", 404)
+		return
+	}
+	writeJSON(w, eni)
+}
+
+// Associates a public or Elastic IP with a private IP of the interface (the primary one unless
+// ?private-ip= is given), moving it from any other interface like AllowReassociation does.
+func (app *App) adminAssociateAddressHandler(w http.ResponseWriter, r *http.Request) {
+	publicIp := mux.Vars(r)["ip"]
+	if net.ParseIP(publicIp).To4() == nil {
+		http.Error(w, fmt.Sprintf("invalid public ip %s", publicIp), 400)
+		return
+	}
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	eni := app.networkInterface(mux.Vars(r)["mac"])
+	if eni == nil {
+		http.Error(w, "network interface not found", 404)
+		return
+	}
+	privateIp := r.URL.Query().Get("private-ip")
+	if privateIp == "" && len(eni.LocalIpv4s) > 0 {
+		privateIp = eni.LocalIpv4s[0]
+	}
+	if !eni.hasPrivateIp(privateIp) {
+		http.Error(w, fmt.Sprintf("%s is not a private ip of %s", privateIp, eni.Mac), 400)
+		return
+	}
+
+	for _, other := range app.NetworkInterfaces {
+		delete(other.Ipv4Associations, publicIp)
+	}
+	if eni.Ipv4Associations == nil {
+		eni.Ipv4Associations = map[string]string{}
+	}
+	eni.Ipv4Associations[publicIp] = privateIp
+	log.Infof("Associated %s with %s on %s", publicIp, privateIp, eni.Mac)
+	writeJSON(w, eni)
+}
+
+func (app *App) adminDisassociateAddressHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	eni := app.networkInterface(mux.Vars(r)["mac"])
+	if eni == nil {
+		http.Error(w, "network interface not found", 404)
+		return
+	}
+	publicIp := mux.Vars(r)["ip"]
+	if _, ok := eni.Ipv4Associations[publicIp]; !ok {
+		http.Error(w, fmt.Sprintf("%s is not associated with %s", publicIp, eni.Mac), 404)
+		return
+	}
+	delete(eni.Ipv4Associations, publicIp)
+	log.Infof("Disassociated %s from %s", publicIp, eni.Mac)
+	writeJSON(w, eni)
+}
+
+func (app *App) adminBlockDeviceMappingsHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	writeJSON(w, app.BlockDeviceMappings)
+}
+
+// Attaches a volume as ebsN, ephemeralN or swap, on ?device= or the next free device name
+func (app *App) adminAttachVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !blockDeviceNameRegexp.MatchString(name) {
+		http.Error(w, fmt.Sprintf("invalid block device mapping name %s, expected ebsN, ephemeralN or swap", name), 400)
+		return
+	}
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if _, ok := app.BlockDeviceMappings[name]; ok {
+		http.Error(w, fmt.Sprintf("%s is already attached", name), 409)
+		return
+	}
+	device := r.URL.Query().Get("device")
+	if device == "" {
+		var err error
+		if device, err = app.nextDeviceName(); err != nil {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+	}
+	for other, used := range app.BlockDeviceMappings {
+		if used == device && other != "ami" {
+			http.Error(w, fmt.Sprintf("%s is already in use by %s", device, other), 409)
+			return
+		}
+	}
+	app.BlockDeviceMappings[name] = device
+	log.Infof("Attached %s as %s", name, device)
+	writeJSON(w, app.BlockDeviceMappings)
+}
+
+func (app *App) adminDetachVolumeHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !blockDeviceNameRegexp.MatchString(name) {
+		http.Error(w, fmt.Sprintf("%s cannot be detached", name), 400)
+		return
+	}
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if _, ok := app.BlockDeviceMappings[name]; !ok {
+		http.Error(w, fmt.Sprintf("%s is not attached", name), 404)
+		return
+	}
+	delete(app.BlockDeviceMappings, name)
+	log.Infof("Detached %s", name)
+	writeJSON(w, app.BlockDeviceMappings)
+}
+
+func (app *App) adminMetadataOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	writeJSON(w, app.metadataOptions())
+}
+
+// Changes the ?http-endpoint=, ?http-put-response-hop-limit= and ?http-protocol-ipv6= given, like
+// ModifyInstanceMetadataOptions does
+func (app *App) adminModifyMetadataOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	options := app.metadataOptions()
+	query := r.URL.Query()
+	if v := query.Get("http-endpoint"); v != "" {
+		options.HttpEndpoint = v
+	}
+	if v := query.Get("http-put-response-hop-limit"); v != "" {
+		hops, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid http-put-response-hop-limit %s", v), 400)
+			return
+		}
+		options.HttpPutResponseHopLimit = hops
+	}
+	if v := query.Get("http-protocol-ipv6"); v != "" {
+		options.HttpProtocolIpv6 = v
+	}
+	if err := options.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	app.HttpEndpoint = options.HttpEndpoint
+	app.HttpPutResponseHopLimit = options.HttpPutResponseHopLimit
+	app.HttpProtocolIpv6 = options.HttpProtocolIpv6
+	log.Infof("Modified metadata options %+v", options)
+	writeJSON(w, options)
+}
+
+func (app *App) adminRateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	writeJSON(w, app.rateLimits())
+}
+
+// Changes the ?rate=, ?burst= and ?drop= given
+func (app *App) adminModifyRateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	rate, burst, drop := app.RateLimit, app.RateLimitBurst, app.RateLimitDrop
+	query := r.URL.Query()
+	var err error
+	if v := query.Get("rate"); v != "" {
+		if rate, err = strconv.ParseFloat(v, 64); err != nil || rate < 0 {
+			http.Error(w, fmt.Sprintf("invalid rate %s", v), 400)
+			return
+		}
+	}
+	if v := query.Get("burst"); v != "" {
+		if burst, err = strconv.Atoi(v); err != nil || burst < 0 {
+			http.Error(w, fmt.Sprintf("invalid burst %s", v), 400)
+			return
+		}
+	}
+	if v := query.Get("drop"); v != "" {
+		if drop, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid drop %s", v), 400)
+			return
+		}
+	}
+
+	app.RateLimit, app.RateLimitBurst, app.RateLimitDrop = rate, burst, drop
+	log.Infof("Modified rate limits to %g requests per second, bursts of %d", rate, app.rateLimitBurst())
+	writeJSON(w, app.rateLimits())
+}
+
+// Zeroes the counters of every client, and refills their buckets
+func (app *App) adminResetRateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	app.limiter.reset()
+	writeJSON(w, app.rateLimits())
+}
+
+func (app *App) adminFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, app.faults.list())
+}
+
+// Adds a fault from the ?path=, ?method=, ?nth=, ?times=, ?probability=, ?latency=, ?status=, ?drop= and
+// ?truncate= given, see Fault
+func (app *App) adminAddFaultHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	f := &Fault{Path: query.Get("path"), Method: query.Get("method"), Latency: query.Get("latency")}
+	var err error
+	for name, value := range map[string]*int{"nth": &f.Nth, "times": &f.Times, "status": &f.Status} {
+		if v := query.Get(name); v != "" {
+			if *value, err = strconv.Atoi(v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s %s", name, v), 400)
+				return
+			}
+		}
+	}
+	if v := query.Get("truncate"); v != "" {
+		truncate, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid truncate %s", v), 400)
+			return
+		}
+		f.Truncate = &truncate
+	}
+	if v := query.Get("probability"); v != "" {
+		if f.Probability, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid probability %s", v), 400)
+			return
+		}
+	}
+	if v := query.Get("drop"); v != "" {
+		if f.Drop, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid drop %s", v), 400)
+			return
+		}
+	}
+
+	if err := app.faults.add(f); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	log.Infof("Added fault %d for %s", f.ID, f.Path)
+	writeJSON(w, app.faults.list())
+}
+
+// Removes the fault with the given ID, or every fault
+func (app *App) adminRemoveFaultHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if !app.faults.remove(id) {
+		http.Error(w, "fault not found", 404)
+		return
+	}
+	writeJSON(w, app.faults.list())
+}
+
+// Shows the steps of the scenario, and which of them have run
+func (app *App) adminScenarioHandler(w http.ResponseWriter, r *http.Request) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	if app.scenario == nil {
+		http.Error(w, "no scenario", 404)
+		return
+	}
+	writeJSON(w, app.scenario)
+}
+
+// Shows the journaled requests matching the ?method=, ?path=, ?client=, ?imds-version= and ?status= given, and
+// how many there are
+func (app *App) adminJournalHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseJournalQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	app.mu.RLock()
+	size := app.JournalSize
+	app.mu.RUnlock()
+	requests := app.journal.query(q, size)
+	writeJSON(w, struct {
+		Count    int            `json:"count"`
+		Requests []JournalEntry `json:"requests"`
+	}{len(requests), requests})
+}
+
+func (app *App) adminResetJournalHandler(w http.ResponseWriter, r *http.Request) {
+	app.journal.reset()
+	app.adminJournalHandler(w, r)
+}
+
+// Serves the metrics in the Prometheus text format
+func (app *App) adminMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	app.writeMetrics(w)
+}
+
+func (app *App) adminClockHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, app.clock.state())
+}
+
+// Sets the clock to ?now=, in RFC 3339 format, advances it by ?advance= and freezes or unfreezes it with ?frozen=
+func (app *App) adminModifyClockHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var now time.Time
+	var advance time.Duration
+	var err error
+	if v := query.Get("now"); v != "" {
+		if now, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid now %s, expected RFC 3339 format", v), 400)
+			return
+		}
+	}
+	if v := query.Get("advance"); v != "" {
+		if advance, err = time.ParseDuration(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid advance %s", v), 400)
+			return
+		}
+	}
+	frozen := false
+	if v := query.Get("frozen"); v != "" {
+		if frozen, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid frozen %s", v), 400)
+			return
+		}
+	}
+
+	if query.Get("frozen") != "" {
+		app.clock.freeze(frozen)
+	}
+	if !now.IsZero() {
+		app.clock.set(now)
+	}
+	if advance != 0 {
+		app.clock.advance(advance)
+	}
+	state := app.clock.state()
+	log.Infof("Modified clock, now %s", state.Now)
+	writeJSON(w, state)
+}
+
+// Goes back to the wall clock
+func (app *App) adminResetClockHandler(w http.ResponseWriter, r *http.Request) {
+	app.clock.reset()
+	writeJSON(w, app.clock.state())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	result, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Errorf("Error marshalling json %+v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	write(w, string(result))
+}
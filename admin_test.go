@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends an admin API request, checking the response status code
+func doAdminTest(t *testing.T, method string, uri string, expected_status int) string {
+	req, err := http.NewRequest(method, testAdminServer.URL+uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != expected_status {
+		t.Errorf("%s %s : Expected HTTP Status Code %d, got %d %s\n", method, uri, expected_status, res.StatusCode, string(body))
+	}
+	return string(body)
+}
+
+func TestAdminAssociateAddress(t *testing.T) {
+	doAdminTest(t, "PUT", "/network-interfaces/0e:11:22:33:44:55/ipv4-associations/3.4.5.6?private-ip=10.20.31.11", 200)
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/public-ipv4s", "3.4.5.6")
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/ipv4-associations/3.4.5.6", "10.20.31.11")
+
+	// Reassociating moves the address between interfaces
+	doAdminTest(t, "PUT", "/network-interfaces/00:aa:bb:cc:dd:ee/ipv4-associations/3.4.5.6", 200)
+	doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/public-ipv4s")
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/public-ipv4s", "3.4.5.6\n54.10.20.30")
+
+	doAdminTest(t, "DELETE", "/network-interfaces/00:aa:bb:cc:dd:ee/ipv4-associations/3.4.5.6", 200)
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/public-ipv4s", "54.10.20.30")
+}
+
+func TestAdminDisassociatePublicIpv4(t *testing.T) {
+	doAdminTest(t, "DELETE", "/network-interfaces/00:aa:bb:cc:dd:ee/ipv4-associations/54.10.20.30", 200)
+	doNotFoundTest(t, "GET", "/latest/meta-data/public-ipv4")
+	doNotFoundTest(t, "GET", "/latest/meta-data/public-hostname")
+
+	doAdminTest(t, "PUT", "/network-interfaces/00:aa:bb:cc:dd:ee/ipv4-associations/54.10.20.30", 200)
+	doBodyTest(t, "GET", "/latest/meta-data/public-ipv4", "54.10.20.30")
+}
+
+func TestAdminAssociateAddressErrors(t *testing.T) {
+	doAdminTest(t, "PUT", "/network-interfaces/00:00:00:00:00:00/ipv4-associations/3.4.5.6", 404)
+	doAdminTest(t, "PUT", "/network-interfaces/00:aa:bb:cc:dd:ee/ipv4-associations/not-an-ip", 400)
+	doAdminTest(t, "PUT", "/network-interfaces/00:aa:bb:cc:dd:ee/ipv4-associations/3.4.5.6?private-ip=10.99.99.99", 400)
+	doAdminTest(t, "DELETE", "/network-interfaces/00:aa:bb:cc:dd:ee/ipv4-associations/3.4.5.6", 404)
+}
+
+func TestAdminAttachDetachVolume(t *testing.T) {
+	doAdminTest(t, "PUT", "/block-device-mappings/ebs2", 200)
+	doAdminTest(t, "PUT", "/block-device-mappings/ebs10?device=/dev/xvdz", 200)
+	doBodyTest(t, "GET", "/latest/meta-data/block-device-mapping/", "ami\nebs1\nebs2\nebs10\nephemeral0\nroot")
+	doBodyTest(t, "GET", "/latest/meta-data/block-device-mapping/ebs2", "/dev/xvdg")
+	doBodyTest(t, "GET", "/latest/meta-data/block-device-mapping/ebs10", "/dev/xvdz")
+
+	doAdminTest(t, "DELETE", "/block-device-mappings/ebs2", 200)
+	doAdminTest(t, "DELETE", "/block-device-mappings/ebs10", 200)
+	doNotFoundTest(t, "GET", "/latest/meta-data/block-device-mapping/ebs2")
+}
+
+func TestAdminAttachDetachVolumeErrors(t *testing.T) {
+	doAdminTest(t, "PUT", "/block-device-mappings/ebs1", 409)
+	doAdminTest(t, "PUT", "/block-device-mappings/ebs3?device=/dev/xvdf", 409)
+	doAdminTest(t, "PUT", "/block-device-mappings/bogus", 400)
+	doAdminTest(t, "DELETE", "/block-device-mappings/root", 400)
+	doAdminTest(t, "DELETE", "/block-device-mappings/swap", 404)
+}
+
+func TestAdminAttachVolumeExhausted(t *testing.T) {
+	testApp.mu.Lock()
+	mappings := testApp.BlockDeviceMappings
+	testApp.BlockDeviceMappings = map[string]string{"ami": "/dev/xvda", "root": "/dev/xvda"}
+	for i, c := 1, 'f'; c <= 'z'; i, c = i+1, c+1 {
+		testApp.BlockDeviceMappings[fmt.Sprintf("ebs%d", i)] = "/dev/xvd" + string(c)
+	}
+	testApp.mu.Unlock()
+	defer func() {
+		testApp.mu.Lock()
+		testApp.BlockDeviceMappings = mappings
+		testApp.mu.Unlock()
+	}()
+
+	doAdminTest(t, "PUT", "/block-device-mappings/ebs30", 409)
+	doNotFoundTest(t, "GET", "/latest/meta-data/block-device-mapping/ebs30")
+}
+
+// Expects the server to drop the connection without a response
+func doDroppedTest(t *testing.T, method string, uri string, headers map[string]string) {
+	req, err := http.NewRequest(method, testServer.URL+uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := testHttpClient().Do(req)
+	if err == nil {
+		res.Body.Close()
+		t.Errorf("%s %s : Expected the connection to be dropped, got HTTP Status Code %d\n", method, uri, res.StatusCode)
+	}
+}
+
+func TestAdminMetadataOptions(t *testing.T) {
+	expected_body := `{
+  "http-endpoint": "enabled",
+  "http-put-response-hop-limit": 1,
+  "http-protocol-ipv6": "enabled"
+}`
+	if body := doAdminTest(t, "GET", "/metadata-options", 200); body != expected_body {
+		t.Errorf("GET /metadata-options : Expected\n\n%s\n\ngot\n\n%s", expected_body, body)
+	}
+
+	doAdminTest(t, "PUT", "/metadata-options?http-endpoint=disabled", 200)
+	doDroppedTest(t, "GET", "/latest/meta-data/instance-id", nil)
+	doAdminTest(t, "PUT", "/metadata-options?http-endpoint=enabled", 200)
+	doBodyTest(t, "GET", "/latest/meta-data/instance-id", "i-asdfasdf")
+
+	doAdminTest(t, "PUT", "/metadata-options?http-endpoint=off", 400)
+	doAdminTest(t, "PUT", "/metadata-options?http-put-response-hop-limit=0", 400)
+	doAdminTest(t, "PUT", "/metadata-options?http-put-response-hop-limit=one", 400)
+	doAdminTest(t, "PUT", "/metadata-options?http-protocol-ipv6=yes", 400)
+}
+
+func TestAdminMetadataOptionsHopLimit(t *testing.T) {
+	// Treat the test client as a container
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	testApp.mu.Lock()
+	testApp.containerNets = []*net.IPNet{loopback}
+	testApp.mu.Unlock()
+	defer func() {
+		testApp.mu.Lock()
+		testApp.containerNets = nil
+		testApp.mu.Unlock()
+		doAdminTest(t, "PUT", "/metadata-options?http-put-response-hop-limit=1", 200)
+	}()
+
+	ttl := map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "21600"}
+	doDroppedTest(t, "PUT", "/latest/api/token", ttl)
+	// IMDSv1 requests are not affected
+	doBodyTest(t, "GET", "/latest/meta-data/instance-id", "i-asdfasdf")
+
+	doAdminTest(t, "PUT", "/metadata-options?http-put-response-hop-limit=2", 200)
+	doTokenRequest(t, "21600")
+}
+
+func TestAdminRateLimits(t *testing.T) {
+	defer doAdminTest(t, "PUT", "/rate-limits?rate=0&burst=0&drop=false", 200)
+	doAdminTest(t, "PUT", "/rate-limits?rate=0.01&burst=2", 200)
+	doAdminTest(t, "DELETE", "/rate-limits/clients", 200)
+
+	doBodyTest(t, "GET", "/latest/meta-data/instance-id", "i-asdfasdf")
+	doBodyTest(t, "GET", "/latest/meta-data/instance-id", "i-asdfasdf")
+	doGoldenTest(t, "throttled", "GET", "/latest/meta-data/instance-id", nil)
+	doAdminTest(t, "PUT", "/rate-limits?drop=true", 200)
+	doDroppedTest(t, "GET", "/latest/meta-data/instance-id", nil)
+
+	expected_body := `{
+  "rate": 0.01,
+  "burst": 2,
+  "drop": true,
+  "clients": {
+    "127.0.0.1": {
+      "requests": 4,
+      "throttled": 2
+    }
+  }
+}`
+	if body := doAdminTest(t, "GET", "/rate-limits", 200); body != expected_body {
+		t.Errorf("GET /rate-limits : Expected\n\n%s\n\ngot\n\n%s", expected_body, body)
+	}
+
+	doAdminTest(t, "PUT", "/rate-limits?rate=-1", 400)
+	doAdminTest(t, "PUT", "/rate-limits?burst=many", 400)
+	doAdminTest(t, "PUT", "/rate-limits?drop=maybe", 400)
+}
+
+func TestAdminFaults(t *testing.T) {
+	defer doAdminTest(t, "DELETE", "/faults", 200)
+
+	doAdminTest(t, "POST", "/faults?path=/latest/meta-data/instance-id&status=503&times=1", 200)
+	doGoldenTest(t, "fault-503", "GET", "/latest/meta-data/instance-id", nil)
+	doBodyTest(t, "GET", "/latest/meta-data/instance-id", "i-asdfasdf")
+
+	doAdminTest(t, "POST", "/faults?path=/latest/meta-data/ami-id&drop=true&nth=2", 200)
+	doBodyTest(t, "GET", "/latest/meta-data/ami-id", "ami-asdfasdf")
+	doDroppedTest(t, "GET", "/latest/meta-data/ami-id", nil)
+	doBodyTest(t, "GET", "/latest/meta-data/ami-id", "ami-asdfasdf")
+
+	doAdminTest(t, "POST", "/faults?path=/latest/meta-data/hostname&truncate=4&latency=50ms", 200)
+	start := time.Now()
+	res, err := testHttpClient().Get(testServer.URL + "/latest/meta-data/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err == nil || string(body) != "test" {
+		t.Errorf("GET /latest/meta-data/hostname : Expected a body truncated to test, got %q (%v)", body, err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("GET /latest/meta-data/hostname : Expected a response after 50ms, got one after %s", time.Since(start))
+	}
+
+	faults := doAdminTest(t, "GET", "/faults", 200)
+	if !strings.Contains(faults, `"matched": 3`) {
+		t.Errorf("GET /faults : Expected the ami-id fault to have matched 3 requests, got\n\n%s", faults)
+	}
+	doAdminTest(t, "DELETE", "/faults/3", 200)
+	doAdminTest(t, "DELETE", "/faults/3", 404)
+	doAdminTest(t, "POST", "/faults?path=/latest/meta-data/hostname", 400)
+	doAdminTest(t, "POST", "/faults?path=/latest/meta-data/hostname&status=abc", 400)
+}
+
+func TestAdminClock(t *testing.T) {
+	defer doAdminTest(t, "DELETE", "/clock", 200)
+	doAdminTest(t, "PUT", "/clock?frozen=true&now=2018-02-26T23:50:00Z", 200)
+
+	body := doGetBody(t, "/latest/meta-data/iam/security-credentials/some-instance-profile")
+	if !strings.Contains(body, `"Expiration" : "2018-02-27T05:50:00Z"`) {
+		t.Errorf("Expected credentials expiring 6 hours after the frozen time, got %s", body)
+	}
+
+	token := doTokenRequest(t, "60")
+	doAdminTest(t, "PUT", "/clock?advance=45s", 200)
+	if status, ttl := doTokenGet(t, "/latest/meta-data/instance-id", token); status != 200 || ttl != "15" {
+		t.Errorf("Expected the token valid for 15 more seconds, got %d %s", status, ttl)
+	}
+	doAdminTest(t, "PUT", "/clock?advance=15s", 200)
+	if status, _ := doTokenGet(t, "/latest/meta-data/instance-id", token); status != 401 {
+		t.Errorf("Expected the token to have expired, got %d", status)
+	}
+
+	body = doAdminTest(t, "GET", "/clock", 200)
+	if !strings.Contains(body, `"now": "2018-02-26T23:51:00Z"`) || !strings.Contains(body, `"frozen": true`) {
+		t.Errorf("Expected the clock frozen at 23:51, got %s", body)
+	}
+	doAdminTest(t, "PUT", "/clock?advance=soon", 400)
+	doAdminTest(t, "PUT", "/clock?now=yesterday", 400)
+}
+
+func TestAdminJournal(t *testing.T) {
+	doAdminTest(t, "DELETE", "/journal", 200)
+
+	doBodyTest(t, "GET", "/latest/meta-data/instance-id", "i-asdfasdf")
+	token := doTokenRequest(t, "21600")
+	if status, _ := doTokenGet(t, "/latest/meta-data/instance-id", token); status != 200 {
+		t.Errorf("Expected a 200 with a valid token, got %d", status)
+	}
+	doNotFoundTest(t, "GET", "/latest/meta-data/unknown")
+
+	counts := map[string]string{
+		"":                 `"count": 4`,
+		"?imds-version=v1": `"count": 2`,
+		"?imds-version=v2": `"count": 2`,
+		"?method=PUT":      `"count": 1`,
+		"?status=404":      `"count": 1`,
+		"?path=/latest/**": `"count": 4`,
+		"?path=/*/meta-data/instance-id&client=127.0.0.1": `"count": 2`,
+	}
+	for query, expected := range counts {
+		if body := doAdminTest(t, "GET", "/journal"+query, 200); !strings.Contains(body, expected) {
+			t.Errorf("GET /journal%s : Expected %s, got %s", query, expected, body)
+		}
+	}
+	body := doAdminTest(t, "GET", "/journal?method=PUT", 200)
+	if !strings.Contains(body, `"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": [`) || !strings.Contains(body, `"token": false`) {
+		t.Errorf("Expected the token PUT with its headers, got %s", body)
+	}
+	doAdminTest(t, "GET", "/journal?imds-version=v3", 400)
+	doAdminTest(t, "GET", "/journal?path=/[", 400)
+}
+
+func TestAdminMetrics(t *testing.T) {
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/local-ipv4s", "10.20.30.40")
+	doNotFoundTest(t, "GET", "/unknown")
+	doTokenRequest(t, "21600")
+
+	body := doAdminTest(t, "GET", "/metrics", 200)
+	for _, expected := range []string{
+		`imds_requests_total{path="/{version}/meta-data/network/interfaces/macs/{mac}/local-ipv4s",status="200",imds_version="v1"} `,
+		`imds_requests_total{path="unmatched",status="404",imds_version="v1"} `,
+		`imds_requests_total{path="/{version}/api/token",status="200",imds_version="v2"} `,
+		`imds_request_duration_seconds_count{path="/{version}/meta-data/network/interfaces/macs/{mac}/local-ipv4s"} `,
+		`imds_client_requests_total{client="127.0.0.1"} `,
+		"# TYPE imds_active_tokens gauge\nimds_active_tokens ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %s, got\n%s", expected, body)
+		}
+	}
+}
+
+func TestAdminHealth(t *testing.T) {
+	doAdminTest(t, "GET", "/healthz", 200)
+	if body := doAdminTest(t, "GET", "/readyz", 503); !strings.Contains(body, "verifying credentials") {
+		t.Errorf("Expected not ready until credentials are verified, got %s", body)
+	}
+	defer testApp.readiness.set(false, "")
+
+	// Mock credentials are always verified
+	testApp.waitForCredentials()
+	doAdminTest(t, "GET", "/readyz", 200)
+	testApp.readiness.set(false, "error verifying credentials: AccessDenied")
+	if body := doAdminTest(t, "GET", "/readyz", 503); !strings.Contains(body, "AccessDenied") {
+		t.Errorf("Expected the reason the server is not ready, got %s", body)
+	}
+}
+
+func TestAdminCertificate(t *testing.T) {
+	cert, err := parseCertificatePEM([]byte(doAdminTest(t, "GET", "/certificate", 200)), "/certificate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	document := doGetBody(t, "/latest/dynamic/instance-identity/document")
+	signature, err := decodeBase64Signature([]byte(doGetBody(t, "/latest/dynamic/instance-identity/signature")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyIdentitySignature(cert, []byte(document), signature); err != nil {
+		t.Errorf("Expected the signature to verify against the served certificate, got %+v", err)
+	}
+}
+
+func TestServeUnlocked(t *testing.T) {
+	app := NewApp()
+	served := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveUnlocked(w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Would deadlock while readLocked holds the read lock
+			app.mu.Lock()
+			served = true
+			app.mu.Unlock()
+		}))
+	})
+	app.readLocked(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !served {
+		t.Errorf("Expected the handler to be served once the lock is released")
+	}
+
+	// Outside readLocked, there is no lock to release
+	served = false
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !served {
+		t.Errorf("Expected the handler to be served straight away")
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"net"
+	"os"
 	"runtime"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -10,53 +14,245 @@ import (
 // App encapsulates all of the parameters necessary for starting up
 // an aws mock metadata server. These can either be set via command line or directly.
 type App struct {
-	AmiID            string
-	AvailabilityZone string
-	AppInterface     string
-	AppPort          string
-	Hostname         string
-	InstanceID       string
-	AccountID        string
-	InstanceType     string
-	MacAddress       string
-	PrivateIp        string
+	// File the parameters are loaded from, using the flag names as keys. Flags take precedence over the file.
+	ConfigFile string `yaml:"-"`
+
+	AmiID            string `yaml:"ami-id"`
+	AvailabilityZone string `yaml:"availability-zone"`
+	AppInterface     string `yaml:"app-interface"`
+	AppPort          string `yaml:"app-port"`
+	// Admin API listener, disabled unless AdminPort is set
+	AdminInterface string `yaml:"admin-interface"`
+	AdminPort      string `yaml:"admin-port"`
+	// Additional IPv6 address to listen on, e.g. fd00:ec2::254
+	AppInterfaceIpv6 string `yaml:"app-interface-ipv6"`
+	Hostname         string `yaml:"hostname"`
+	InstanceID       string `yaml:"instance-id"`
+	AccountID        string `yaml:"account-id"`
+	InstanceType     string `yaml:"instance-type"`
+	ReservationID    string `yaml:"reservation-id"`
+	MacAddress       string `yaml:"mac-address"`
+	PrivateIp        string `yaml:"private-ip"`
 	// If set, will return mocked credentials to the IAM instance profile instead of using STS to retrieve real credentials.
-	MockInstanceProfile   bool
-	RoleArn               string
-	RoleName              string
-	Verbose               bool
-	VpcID                 string
-	NoSchemeHostRedirects bool
+	MockInstanceProfile   bool   `yaml:"mock-instance-profile"`
+	RoleArn               string `yaml:"role-arn"`
+	RoleName              string `yaml:"role-name"`
+	Verbose               bool   `yaml:"verbose"`
+	VpcID                 string `yaml:"vpc-id"`
+	NoSchemeHostRedirects bool   `yaml:"no-scheme-host-redirects"`
+	// Where trailing slash redirects point, see trailingSlashRedirect
+	RedirectBaseURL       string `yaml:"redirect-base-url"`
+	RedirectToRequestHost bool   `yaml:"redirect-to-request-host"`
+	NoRedirects           bool   `yaml:"no-redirects"`
+	// Instance tags, only served under tags/instance/ when InstanceMetadataTags is enabled
+	Tags                 map[string]string `yaml:"tags"`
+	InstanceMetadataTags bool              `yaml:"instance-metadata-tags"`
+	// Virtual device names (ami, root, ebsN, ephemeralN, swap) mapped to devices, ami and root default to RootDeviceName
+	BlockDeviceMappings map[string]string `yaml:"block-device-mappings"`
+	RootDeviceName      string            `yaml:"root-device-name"`
+	// SSH key pairs served under public-keys/. KeyName and PublicKeyFile add one in front of the configured ones.
+	PublicKeys    []PublicKey `yaml:"public-keys"`
+	KeyName       string      `yaml:"key-name"`
+	PublicKeyFile string      `yaml:"public-key-file"`
+	// Primary network interface details, used when NetworkInterfaces is not set
+	InterfaceID         string `yaml:"interface-id"`
+	SubnetID            string `yaml:"subnet-id"`
+	SubnetIpv4CidrBlock string `yaml:"subnet-ipv4-cidr-block"`
+	VpcIpv4CidrBlock    string `yaml:"vpc-ipv4-cidr-block"`
+	Ipv6                string `yaml:"ipv6"`
+	PublicIpv4          string `yaml:"public-ipv4"`
+	PublicHostname      string `yaml:"public-hostname"`
+	SubnetIpv6CidrBlock string `yaml:"subnet-ipv6-cidr-block"`
+	VpcIpv6CidrBlock    string `yaml:"vpc-ipv6-cidr-block"`
+	// All network interfaces attached to the instance, only settable from the config file
+	NetworkInterfaces []*NetworkInterface `yaml:"network-interfaces"`
+
+	// Derived from AvailabilityZone when not set
+	AvailabilityZoneID string `yaml:"availability-zone-id"`
+	Region             string `yaml:"region"`
+	// Placement group and dedicated host, only listed when set
+	PlacementGroupName       string `yaml:"placement-group-name"`
+	PlacementPartitionNumber int    `yaml:"placement-partition-number"`
+	HostID                   string `yaml:"host-id"`
+
+	// PEM files holding the key and certificate used to sign instance identity documents.
+	IdentityKeyFile  string `yaml:"identity-key-file"`
+	IdentityCertFile string `yaml:"identity-cert-file"`
+	// Instance identity document fields
+	Architecture            string   `yaml:"architecture"`
+	BillingProducts         []string `yaml:"billing-products"`
+	DevpayProductCodes      []string `yaml:"devpay-product-codes"`
+	MarketplaceProductCodes []string `yaml:"marketplace-product-codes"`
+	KernelID                string   `yaml:"kernel-id"`
+	RamdiskID               string   `yaml:"ramdisk-id"`
+	// RFC 3339 time the instance was launched at, reported as pendingTime. Defaults to the server start time.
+	LaunchTime              string `yaml:"launch-time"`
+	IdentityDocumentVersion string `yaml:"identity-document-version"`
+	// ModifyInstanceMetadataOptions settings, see enforceMetadataOptions
+	HttpEndpoint            string `yaml:"http-endpoint"`
+	HttpPutResponseHopLimit int    `yaml:"http-put-response-hop-limit"`
+	HttpProtocolIpv6        string `yaml:"http-protocol-ipv6"`
+	// Networks of containers on the instance, whose requests are one hop further away
+	ContainerCidrs []string `yaml:"container-cidrs"`
+	// Requests per second each client (source IP) can make, 0 for no limit, see rateLimit
+	RateLimit      float64 `yaml:"rate-limit"`
+	RateLimitBurst int     `yaml:"rate-limit-burst"`
+	RateLimitDrop  bool    `yaml:"rate-limit-drop"`
+	// Faults injected into matching responses, only configurable in the config file or through the admin API
+	Faults []*Fault `yaml:"faults"`
+	// Timeouts of the http servers, 0 for none, and how long to wait for requests in flight when shutting down
+	ReadTimeout     time.Duration `yaml:"read-timeout"`
+	WriteTimeout    time.Duration `yaml:"write-timeout"`
+	IdleTimeout     time.Duration `yaml:"idle-timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+	// Log level (debug, info, warn or error), format (text, logfmt or json) and output (stderr, stdout or a file).
+	// Every request is logged at info level, see observeRequests.
+	LogLevel  string `yaml:"log-level"`
+	LogFormat string `yaml:"log-format"`
+	LogOutput string `yaml:"log-output"`
+	// Most recent requests kept in the journal, 0 to keep none
+	JournalSize int `yaml:"journal-size"`
+	// YAML timeline of changes made to the instance once the server starts, see Scenario
+	ScenarioFile string `yaml:"scenario-file"`
+	// RFC 3339 time the clock starts at, and whether it stands still, see clock
+	ClockStart  string `yaml:"clock-start"`
+	FreezeClock bool   `yaml:"freeze-clock"`
+
+	// Command line arguments the App was loaded from, parsed again on reload, one at a time
+	args      []string
+	reloading sync.Mutex
+
+	// Guards the state the admin API can change at runtime
+	mu             sync.RWMutex
+	router         *router
+	identitySigner *identitySigner
+	launchTime     time.Time
+	tokens         tokenStore
+	containerNets  []*net.IPNet
+	limiter        rateLimiter
+	faults         faultInjector
+	scenario       *Scenario
+	clock          clock
+	journal        requestJournal
+	metrics        metrics
+	readiness      readiness
+	logging        *loggingConfig
+	credentials    mockCredentialStore
+	// Changed by scenarios, see runScenarioStep
+	spotInstanceAction *SpotInstanceAction
+}
+
+// NewApp returns an App with the same defaults as the command line flags.
+func NewApp() *App {
+	return &App{
+		Architecture:            "x86_64",
+		RootDeviceName:          "/dev/xvda",
+		IdentityDocumentVersion: "2010-08-31",
+		RedirectBaseURL:         "http://169.254.169.254",
+		HttpEndpoint:            "enabled",
+		HttpPutResponseHopLimit: 1,
+		HttpProtocolIpv6:        "enabled",
+		JournalSize:             10000,
+		ReadTimeout:             10 * time.Second,
+		IdleTimeout:             60 * time.Second,
+		ShutdownTimeout:         30 * time.Second,
+		LogLevel:                "info",
+		LogFormat:               "text",
+		LogOutput:               "stderr",
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	app := &App{}
-	app.addFlags(pflag.CommandLine)
-	pflag.Parse()
+	app, err := loadApp(os.Args[1:])
+	if err == pflag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatalf("Error loading configuration: %+v", err)
+	}
 
-	if app.Verbose {
-		log.SetLevel(log.DebugLevel)
+	if err := app.configureLogging(app); err != nil {
+		log.Fatalf("Error configuring logging: %+v", err)
 	}
 
 	app.StartServer()
 }
 
 func (app *App) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&app.ConfigFile, "config", app.ConfigFile, "YAML file to load parameters from, keyed by flag name")
 	fs.StringVar(&app.AmiID, "ami-id", app.AmiID, "EC2 Instance AMI ID")
 	fs.StringVar(&app.AvailabilityZone, "availability-zone", app.AvailabilityZone, "Availability Zone")
+	fs.StringVar(&app.AvailabilityZoneID, "availability-zone-id", app.AvailabilityZoneID, "Availability Zone ID (default: derived from the Availability Zone)")
+	fs.StringVar(&app.Region, "region", app.Region, "Region (default: derived from the Availability Zone)")
+	fs.StringVar(&app.PlacementGroupName, "placement-group-name", app.PlacementGroupName, "Placement group the instance is launched in")
+	fs.IntVar(&app.PlacementPartitionNumber, "placement-partition-number", app.PlacementPartitionNumber, "Partition number in a partition placement group")
+	fs.StringVar(&app.HostID, "host-id", app.HostID, "Dedicated Host ID the instance runs on")
 	fs.StringVar(&app.AppInterface, "app-interface", app.AppInterface, "HTTP Network Interface")
+	fs.StringVar(&app.AdminInterface, "admin-interface", app.AdminInterface, "Admin API HTTP Network Interface")
+	fs.StringVar(&app.AdminPort, "admin-port", app.AdminPort, "Admin API HTTP Port (disabled if not set)")
+	fs.StringVar(&app.AppInterfaceIpv6, "app-interface-ipv6", app.AppInterfaceIpv6, "Additional IPv6 HTTP Network Interface, e.g. fd00:ec2::254")
 	fs.StringVar(&app.AppPort, "app-port", app.AppPort, "HTTP Port")
 	fs.StringVar(&app.Hostname, "hostname", app.Hostname, "EC2 Instance Hostname")
 	fs.StringVar(&app.InstanceID, "instance-id", app.InstanceID, "EC2 Instance ID")
 	fs.StringVar(&app.InstanceType, "instance-type", app.InstanceType, "EC2 Instance Type")
+	fs.StringVar(&app.ReservationID, "reservation-id", app.ReservationID, "EC2 Reservation ID (default: derived from the Instance ID)")
+	fs.StringToStringVar(&app.Tags, "tags", app.Tags, "Instance tags, e.g. Name=web,Environment=dev")
+	fs.BoolVar(&app.InstanceMetadataTags, "instance-metadata-tags", app.InstanceMetadataTags, "Allow access to instance tags from the instance metadata")
+	fs.StringToStringVar(&app.BlockDeviceMappings, "block-device-mappings", app.BlockDeviceMappings, "Block device mappings, e.g. ebs1=/dev/xvdf,ephemeral0=/dev/xvdb")
+	fs.StringVar(&app.RootDeviceName, "root-device-name", app.RootDeviceName, "Root device name, e.g. /dev/xvda, /dev/sda1 or /dev/nvme0n1")
+	fs.StringVar(&app.KeyName, "key-name", app.KeyName, "EC2 Key Pair name")
+	fs.StringVar(&app.PublicKeyFile, "public-key-file", app.PublicKeyFile, "OpenSSH public key file for the Key Pair")
 	fs.StringVar(&app.AccountID, "account-id", app.AccountID, "AWS Account ID")
 	fs.StringVar(&app.MacAddress, "mac-address", app.MacAddress, "ENI MAC Address")
 	fs.StringVar(&app.PrivateIp, "private-ip", app.PrivateIp, "ENI Private IP")
-	fs.BoolVar(&app.MockInstanceProfile, "mock-instance-profile", false, "Use mocked IAM Instance Profile credentials (instead of STS generated credentials)")
+	fs.BoolVar(&app.MockInstanceProfile, "mock-instance-profile", app.MockInstanceProfile, "Use mocked IAM Instance Profile credentials (instead of STS generated credentials)")
 	fs.StringVar(&app.RoleArn, "role-arn", app.RoleArn, "IAM Role ARN")
 	fs.StringVar(&app.RoleName, "role-name", app.RoleName, "IAM Role Name")
-	fs.BoolVar(&app.Verbose, "verbose", false, "Verbose")
+	fs.BoolVar(&app.Verbose, "verbose", app.Verbose, "Verbose")
+	fs.DurationVar(&app.ReadTimeout, "read-timeout", app.ReadTimeout, "Time allowed to read a request, 0 for no limit")
+	fs.DurationVar(&app.WriteTimeout, "write-timeout", app.WriteTimeout, "Time allowed to write a response, including injected latency, 0 for no limit")
+	fs.DurationVar(&app.IdleTimeout, "idle-timeout", app.IdleTimeout, "Time keep-alive connections are kept open between requests, 0 for no limit")
+	fs.DurationVar(&app.ShutdownTimeout, "shutdown-timeout", app.ShutdownTimeout, "Time allowed for requests in flight to complete on SIGTERM or SIGINT")
+	fs.StringVar(&app.LogLevel, "log-level", app.LogLevel, "Log level: debug, info (logging every request), warn or error")
+	fs.StringVar(&app.LogFormat, "log-format", app.LogFormat, "Log format: text, logfmt or json")
+	fs.StringVar(&app.LogOutput, "log-output", app.LogOutput, "Log output: stderr, stdout or a file to append to")
 	fs.StringVar(&app.VpcID, "vpc-id", app.VpcID, "VPC ID")
+	fs.StringVar(&app.InterfaceID, "interface-id", app.InterfaceID, "ENI ID")
+	fs.StringVar(&app.SubnetID, "subnet-id", app.SubnetID, "ENI Subnet ID")
+	fs.StringVar(&app.SubnetIpv4CidrBlock, "subnet-ipv4-cidr-block", app.SubnetIpv4CidrBlock, "ENI Subnet IPv4 CIDR block")
+	fs.StringVar(&app.VpcIpv4CidrBlock, "vpc-ipv4-cidr-block", app.VpcIpv4CidrBlock, "VPC IPv4 CIDR block")
+	fs.StringVar(&app.PublicIpv4, "public-ipv4", app.PublicIpv4, "ENI Public IP")
+	fs.StringVar(&app.PublicHostname, "public-hostname", app.PublicHostname, "ENI Public Hostname (default: derived from the Public IP)")
+	fs.StringVar(&app.Ipv6, "ipv6", app.Ipv6, "ENI IPv6 address")
+	fs.StringVar(&app.SubnetIpv6CidrBlock, "subnet-ipv6-cidr-block", app.SubnetIpv6CidrBlock, "ENI Subnet IPv6 CIDR block")
+	fs.StringVar(&app.VpcIpv6CidrBlock, "vpc-ipv6-cidr-block", app.VpcIpv6CidrBlock, "VPC IPv6 CIDR block")
 	fs.BoolVar(&app.NoSchemeHostRedirects, "no-scheme-host-redirects", app.NoSchemeHostRedirects, "Disable the scheme://host prefix in Location redirect headers")
+	fs.StringVar(&app.RedirectBaseURL, "redirect-base-url", app.RedirectBaseURL, "Scheme://host[:port][/path] prefix of Location redirect headers")
+	fs.BoolVar(&app.RedirectToRequestHost, "redirect-to-request-host", app.RedirectToRequestHost, "Build Location redirect headers from the request's Host instead of --redirect-base-url")
+	fs.BoolVar(&app.NoRedirects, "no-redirects", app.NoRedirects, "Serve directory listings without a trailing slash instead of redirecting")
+	fs.StringVar(&app.IdentityKeyFile, "identity-key-file", app.IdentityKeyFile, "PEM RSA key used to sign instance identity documents (generated if missing)")
+	fs.StringVar(&app.IdentityCertFile, "identity-cert-file", app.IdentityCertFile, "PEM certificate used to verify instance identity documents (generated if missing)")
+	fs.StringVar(&app.Architecture, "architecture", app.Architecture, "EC2 Instance architecture (i386, x86_64 or arm64)")
+	fs.StringSliceVar(&app.BillingProducts, "billing-products", app.BillingProducts, "Billing product codes in the instance identity document")
+	fs.StringSliceVar(&app.DevpayProductCodes, "devpay-product-codes", app.DevpayProductCodes, "DevPay product codes in the instance identity document")
+	fs.StringSliceVar(&app.MarketplaceProductCodes, "marketplace-product-codes", app.MarketplaceProductCodes, "Marketplace product codes in the instance identity document")
+	fs.StringVar(&app.KernelID, "kernel-id", app.KernelID, "EC2 Instance kernel ID")
+	fs.StringVar(&app.RamdiskID, "ramdisk-id", app.RamdiskID, "EC2 Instance RAM disk ID")
+	fs.StringVar(&app.LaunchTime, "launch-time", app.LaunchTime, "EC2 Instance launch time in RFC 3339 format (default: server start time)")
+	fs.StringVar(&app.IdentityDocumentVersion, "identity-document-version", app.IdentityDocumentVersion, "Instance identity document version")
+	fs.StringVar(&app.HttpEndpoint, "http-endpoint", app.HttpEndpoint, "Metadata endpoint state, enabled or disabled (connections are dropped)")
+	fs.IntVar(&app.HttpPutResponseHopLimit, "http-put-response-hop-limit", app.HttpPutResponseHopLimit, "Network hops token PUT responses can travel, see --container-cidrs")
+	fs.StringVar(&app.HttpProtocolIpv6, "http-protocol-ipv6", app.HttpProtocolIpv6, "IPv6 metadata endpoint state, enabled or disabled")
+	fs.StringSliceVar(&app.ContainerCidrs, "container-cidrs", app.ContainerCidrs, "Container network CIDRs, whose clients are 2 hops away (e.g. 172.17.0.0/16)")
+	fs.Float64Var(&app.RateLimit, "rate-limit", app.RateLimit, "Requests per second each client IP can make before being throttled (default: no limit)")
+	fs.IntVar(&app.RateLimitBurst, "rate-limit-burst", app.RateLimitBurst, "Requests each client IP can make at once (default: a second's worth)")
+	fs.BoolVar(&app.RateLimitDrop, "rate-limit-drop", app.RateLimitDrop, "Drop the connections of throttled requests instead of responding with a 429")
+	fs.IntVar(&app.JournalSize, "journal-size", app.JournalSize, "Most recent requests kept in the journal the admin API serves, 0 to keep none")
+	fs.StringVar(&app.ClockStart, "clock-start", app.ClockStart, "Time in RFC 3339 format the clock starts at (default: the current time)")
+	fs.BoolVar(&app.FreezeClock, "freeze-clock", app.FreezeClock, "Stop the clock, until it is set or advanced through the admin API")
+	fs.StringVar(&app.ScenarioFile, "scenario-file", app.ScenarioFile, "YAML timeline of changes to make to the instance once the server starts")
 }
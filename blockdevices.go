@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Virtual device names that can be attached and detached, ami and root are fixed at launch
+var blockDeviceNameRegexp = regexp.MustCompile(`^(ebs[0-9]+|ephemeral[0-9]+|swap)$`)
+
+// prepareBlockDeviceMappings defaults the ami and root mappings to the root device
+func (app *App) prepareBlockDeviceMappings() error {
+	if app.BlockDeviceMappings == nil {
+		app.BlockDeviceMappings = map[string]string{}
+	}
+	for name := range app.BlockDeviceMappings {
+		if name != "ami" && name != "root" && !blockDeviceNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid block device mapping name %s", name)
+		}
+	}
+	if _, ok := app.BlockDeviceMappings["ami"]; !ok {
+		app.BlockDeviceMappings["ami"] = app.RootDeviceName
+	}
+	if _, ok := app.BlockDeviceMappings["root"]; !ok {
+		app.BlockDeviceMappings["root"] = app.RootDeviceName
+	}
+	return nil
+}
+
+// blockDeviceNames returns the mapping names in the order the metadata service lists them,
+// numbered ones sorting numerically so ebs10 comes after ebs2
+func (app *App) blockDeviceNames() []string {
+	names := make([]string, 0, len(app.BlockDeviceMappings))
+	for name := range app.BlockDeviceMappings {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, an := splitBlockDeviceName(names[i])
+		b, bn := splitBlockDeviceName(names[j])
+		if a != b {
+			return a < b
+		}
+		return an < bn
+	})
+	return names
+}
+
+func splitBlockDeviceName(name string) (string, int) {
+	prefix := strings.TrimRight(name, "0123456789")
+	n, _ := strconv.Atoi(name[len(prefix):])
+	return prefix, n
+}
+
+// nextDeviceName picks the first free device name following the root device's naming scheme,
+// /dev/nvme1n1 for Nitro style /dev/nvme0n1 roots, /dev/sdf for /dev/sda1 and /dev/xvdf otherwise.
+// It fails once /dev/sdz or /dev/xvdz is used.
+func (app *App) nextDeviceName() (string, error) {
+	used := map[string]bool{}
+	for _, device := range app.BlockDeviceMappings {
+		used[device] = true
+	}
+	if strings.HasPrefix(app.RootDeviceName, "/dev/nvme") {
+		for i := 1; ; i++ {
+			if device := fmt.Sprintf("/dev/nvme%dn1", i); !used[device] {
+				return device, nil
+			}
+		}
+	}
+	prefix := "/dev/xvd"
+	if strings.HasPrefix(app.RootDeviceName, "/dev/sd") {
+		prefix = "/dev/sd"
+	}
+	for c := 'f'; c <= 'z'; c++ {
+		if device := prefix + string(c); !used[device] {
+			return device, nil
+		}
+	}
+	return "", fmt.Errorf("no free device names left, from %sf to %sz", prefix, prefix)
+}
+
+func (app *App) blockDeviceMappingHandler(w http.ResponseWriter, r *http.Request) {
+	write(w, strings.Join(app.blockDeviceNames(), "\n"))
+}
+
+func (app *App) blockDeviceMappingNameHandler(w http.ResponseWriter, r *http.Request) {
+	device, ok := app.BlockDeviceMappings[pathVar(r, "name")]
+	if !ok {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, device)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// clock is the time credentials, tokens, spot interruptions and scenarios run on. It follows the wall clock, but
+// can be frozen, set or advanced through the admin API, so expiry and refresh can be tested instantly.
+type clock struct {
+	mu     sync.Mutex
+	offset time.Duration
+	frozen *time.Time
+	// Closed and replaced whenever the clock is changed, to wake up sleepUntil
+	changed chan struct{}
+}
+
+// ClockState is the state of the clock, as shown by the admin API
+type ClockState struct {
+	Now    string `json:"now"`
+	Frozen bool   `json:"frozen"`
+	Offset string `json:"offset"`
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nowLocked()
+}
+
+func (c *clock) nowLocked() time.Time {
+	if c.frozen != nil {
+		return *c.frozen
+	}
+	return time.Now().UTC().Add(c.offset)
+}
+
+func (c *clock) state() ClockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.nowLocked()
+	return ClockState{
+		Now:    now.Format(time.RFC3339Nano),
+		Frozen: c.frozen != nil,
+		Offset: now.Sub(time.Now().UTC()).Round(time.Millisecond).String(),
+	}
+}
+
+// changes returns the channel closed on the next change, c.mu must be held
+func (c *clock) changes() chan struct{} {
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.changed
+}
+
+// change applies fn to the clock and wakes up anything sleeping on it
+func (c *clock) change(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn()
+	close(c.changes())
+	c.changed = nil
+}
+
+// set moves the clock to t, staying frozen if it was
+func (c *clock) set(t time.Time) {
+	c.change(func() {
+		if c.frozen != nil {
+			t := t.UTC()
+			c.frozen = &t
+		} else {
+			c.offset = t.Sub(time.Now())
+		}
+	})
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.change(func() {
+		if c.frozen != nil {
+			t := c.frozen.Add(d)
+			c.frozen = &t
+		} else {
+			c.offset += d
+		}
+	})
+}
+
+// freeze stops the clock at the current time, or lets it run again from the time it was frozen at
+func (c *clock) freeze(frozen bool) {
+	c.change(func() {
+		switch {
+		case frozen && c.frozen == nil:
+			t := c.nowLocked()
+			c.frozen = &t
+		case !frozen && c.frozen != nil:
+			c.offset = c.frozen.Sub(time.Now())
+			c.frozen = nil
+		}
+	})
+}
+
+// reset goes back to the wall clock
+func (c *clock) reset() {
+	c.change(func() {
+		c.offset = 0
+		c.frozen = nil
+	})
+}
+
+// sleepUntil returns once the clock reaches t, whether by the passing of time or by being set or advanced
+func (c *clock) sleepUntil(t time.Time) {
+	for {
+		c.mu.Lock()
+		now, frozen, changed := c.nowLocked(), c.frozen != nil, c.changes()
+		c.mu.Unlock()
+		if !now.Before(t) {
+			return
+		}
+		if frozen {
+			<-changed
+			continue
+		}
+		timer := time.NewTimer(t.Sub(now))
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
+// prepareClock starts the clock at ClockStart, if set, and freezes it if FreezeClock is set
+func (app *App) prepareClock() error {
+	app.clock.reset()
+	if app.ClockStart != "" {
+		t, err := time.Parse(time.RFC3339, app.ClockStart)
+		if err != nil {
+			return fmt.Errorf("invalid clock start %s: %+v", app.ClockStart, err)
+		}
+		app.clock.set(t)
+	}
+	if app.FreezeClock {
+		app.clock.freeze(true)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	var c clock
+	start := time.Date(2018, 2, 26, 23, 50, 0, 0, time.UTC)
+	c.freeze(true)
+	c.set(start)
+	if now := c.now(); !now.Equal(start) {
+		t.Errorf("Expected the frozen clock at %s, got %s", start, now)
+	}
+	c.advance(time.Hour)
+	if now := c.now(); !now.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected the clock advanced by an hour, got %s", now)
+	}
+
+	// Unfrozen, the clock runs on from where it stood
+	c.freeze(false)
+	if now := c.now(); now.Before(start.Add(time.Hour)) || now.After(start.Add(time.Hour+time.Second)) {
+		t.Errorf("Expected the clock to run on from %s, got %s", start.Add(time.Hour), now)
+	}
+	if state := c.state(); state.Frozen {
+		t.Errorf("Expected the clock to run, got %+v", state)
+	}
+	c.reset()
+	if d := time.Since(c.now()); d < 0 || d > time.Second {
+		t.Errorf("Expected the wall clock, got %s", c.now())
+	}
+}
+
+func TestClockSleepUntil(t *testing.T) {
+	var c clock
+	c.freeze(true)
+	until := c.now().Add(time.Hour)
+	done := make(chan struct{})
+	go func() {
+		c.sleepUntil(until)
+		close(done)
+	}()
+
+	c.advance(30 * time.Minute)
+	select {
+	case <-done:
+		t.Fatalf("Expected sleepUntil to wait for the rest of the hour")
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.advance(30 * time.Minute)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Expected advancing the clock to wake sleepUntil")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// loadApp builds an App from command line arguments. When --config is given the file is
+// loaded first and the arguments parsed again on top of it, so flags override the file.
+func loadApp(args []string) (*App, error) {
+	app := NewApp()
+	app.args = args
+	if err := app.parseFlags(args); err != nil {
+		return nil, err
+	}
+	if app.ConfigFile == "" {
+		return app, nil
+	}
+
+	configured := NewApp()
+	configured.args = args
+	if err := configured.readConfigFile(app.ConfigFile); err != nil {
+		return nil, err
+	}
+	if err := configured.parseFlags(args); err != nil {
+		return nil, err
+	}
+	return configured, nil
+}
+
+func (app *App) parseFlags(args []string) error {
+	fs := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+	app.addFlags(fs)
+	return fs.Parse(args)
+}
+
+// readConfigFile loads the YAML file into app, rejecting unknown keys to catch typos
+func (app *App) readConfigFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error reading config %s: %+v", file, err)
+	}
+	if err := yaml.UnmarshalStrict(data, app); err != nil {
+		return fmt.Errorf("error parsing config %s: %+v", file, err)
+	}
+	return nil
+}
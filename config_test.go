@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadAppConfigFile(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{"config.yaml": `
+instance-id: i-fromconfig
+instance-type: m5.large
+availability-zone: eu-west-1b
+read-timeout: 5s
+network-interfaces:
+  - mac: 0E:00:00:00:00:02
+    device-number: 1
+    local-ipv4s: [172.16.1.20]
+  - mac: 0e:00:00:00:00:01
+    local-ipv4s: [172.16.0.10, 172.16.0.11]
+`})
+	defer cleanup()
+
+	app, err := loadApp([]string{"--config", paths["config.yaml"], "--instance-type", "c5.xlarge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.InstanceID != "i-fromconfig" {
+		t.Errorf("Expected instance ID from the config file, got %s", app.InstanceID)
+	}
+	if app.ReadTimeout != 5*time.Second || app.IdleTimeout != time.Minute {
+		t.Errorf("Expected a read timeout of 5s from the config file and the default idle timeout, got %s %s", app.ReadTimeout, app.IdleTimeout)
+	}
+	if app.InstanceType != "c5.xlarge" {
+		t.Errorf("Expected the instance-type flag to override the config file, got %s", app.InstanceType)
+	}
+	if err := app.prepareNetworkInterfaces(); err != nil {
+		t.Fatal(err)
+	}
+	if app.primaryMac() != "0e:00:00:00:00:01" || app.primaryPrivateIp() != "172.16.0.10" {
+		t.Errorf("Expected primary interface 0e:00:00:00:00:01 172.16.0.10, got %s %s", app.primaryMac(), app.primaryPrivateIp())
+	}
+	if eni := app.networkInterface("0e:00:00:00:00:02"); eni == nil || eni.LocalHostname != "ip-172-16-1-20.eu-west-1.compute.internal" {
+		t.Errorf("Expected secondary interface with a derived local-hostname, got %+v", eni)
+	}
+}
+
+func TestLoadAppConfigFileUnknownKey(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{"config.yaml": "instance-idd: i-typo\n"})
+	defer cleanup()
+
+	if _, err := loadApp([]string{"--config", paths["config.yaml"]}); err == nil {
+		t.Errorf("Expected an error for an unknown config key")
+	}
+}
+
+func TestPrepareNetworkInterfacesFromFlags(t *testing.T) {
+	app, err := loadApp([]string{"--mac-address", "0e:aa:aa:aa:aa:aa", "--private-ip", "10.0.0.5", "--vpc-id", "vpc-1", "--account-id", "111122223333"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.prepareNetworkInterfaces(); err != nil {
+		t.Fatal(err)
+	}
+	eni := app.networkInterface("0e:aa:aa:aa:aa:aa")
+	if eni == nil || eni.InterfaceID != "eni-0eaaaaaaaaaa" || eni.OwnerID != "111122223333" || eni.VpcID != "vpc-1" {
+		t.Errorf("Expected a primary interface built from the flags, got %+v", eni)
+	}
+}
+
+func TestPrepareNetworkInterfacesIpv6FromFlags(t *testing.T) {
+	app, err := loadApp([]string{"--mac-address", "0e:aa:aa:aa:aa:aa", "--ipv6", "2600:1f18::10",
+		"--subnet-ipv6-cidr-block", "2600:1f18::/64", "--vpc-ipv6-cidr-block", "2600:1f18::/56"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.prepareNetworkInterfaces(); err != nil {
+		t.Fatal(err)
+	}
+	eni := app.primaryNetworkInterface()
+	if app.primaryIpv6() != "2600:1f18::10" || len(eni.SubnetIpv6CidrBlocks) != 1 || len(eni.VpcIpv6CidrBlocks) != 1 {
+		t.Errorf("Expected a dual stack primary interface built from the flags, got %+v", eni)
+	}
+}
+
+func TestPrepareNetworkInterfacesDuplicates(t *testing.T) {
+	app := NewApp()
+	app.NetworkInterfaces = []*NetworkInterface{{Mac: "0e:00:00:00:00:01"}, {Mac: "0E:00:00:00:00:01", DeviceNumber: 1}}
+	if err := app.prepareNetworkInterfaces(); err == nil {
+		t.Errorf("Expected an error for duplicate macs")
+	}
+	app.NetworkInterfaces = []*NetworkInterface{{Mac: "0e:00:00:00:00:01"}, {Mac: "0e:00:00:00:00:02"}}
+	if err := app.prepareNetworkInterfaces(); err == nil {
+		t.Errorf("Expected an error for duplicate device numbers")
+	}
+}
+
+func TestPrepareMetadataOptions(t *testing.T) {
+	app, err := loadApp([]string{"--http-put-response-hop-limit", "2", "--container-cidrs", "172.17.0.0/16,10.88.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.prepareMetadataOptions(); err != nil {
+		t.Fatal(err)
+	}
+	if len(app.containerNets) != 2 || app.HttpPutResponseHopLimit != 2 {
+		t.Errorf("Expected 2 container networks and a hop limit of 2, got %v and %d", app.containerNets, app.HttpPutResponseHopLimit)
+	}
+
+	app.ContainerCidrs = []string{"172.17.0.0"}
+	if err := app.prepareMetadataOptions(); err == nil {
+		t.Errorf("Expected an error for an invalid container cidr")
+	}
+	app.ContainerCidrs = nil
+	app.HttpEndpoint = "off"
+	if err := app.prepareMetadataOptions(); err == nil {
+		t.Errorf("Expected an error for an invalid http-endpoint")
+	}
+}
+
+func TestPreparePublicKeyFile(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{"id_rsa.pub": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5 me@host\n"})
+	defer cleanup()
+
+	app, err := loadApp([]string{"--key-name", "my-key", "--public-key-file", paths["id_rsa.pub"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if len(app.PublicKeys) != 1 || app.PublicKeys[0].Name != "my-key" || app.PublicKeys[0].OpensshKey != "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5 me@host" {
+		t.Errorf("Expected the key pair from the flags, got %+v", app.PublicKeys)
+	}
+}
+
+func TestNextDeviceName(t *testing.T) {
+	tests := map[string]string{
+		"/dev/xvda":    "/dev/xvdg",
+		"/dev/sda1":    "/dev/sdf",
+		"/dev/nvme0n1": "/dev/nvme1n1",
+	}
+	for root, expected := range tests {
+		app := NewApp()
+		app.RootDeviceName = root
+		app.BlockDeviceMappings = map[string]string{"ebs1": "/dev/xvdf"}
+		if err := app.prepareBlockDeviceMappings(); err != nil {
+			t.Fatal(err)
+		}
+		if device, err := app.nextDeviceName(); err != nil || device != expected {
+			t.Errorf("%s : Expected next device %s, got %s %+v", root, expected, device, err)
+		}
+		if app.BlockDeviceMappings["root"] != root || app.BlockDeviceMappings["ami"] != root {
+			t.Errorf("%s : Expected ami and root to default to the root device, got %v", root, app.BlockDeviceMappings)
+		}
+	}
+}
+
+func TestNextDeviceNameExhausted(t *testing.T) {
+	app := NewApp()
+	app.BlockDeviceMappings = map[string]string{}
+	for c := 'f'; c <= 'z'; c++ {
+		app.BlockDeviceMappings["ebs"+string(c)] = "/dev/xvd" + string(c)
+	}
+	if device, err := app.nextDeviceName(); err == nil {
+		t.Errorf("Expected an error once every device name is used, got %s", device)
+	}
+}
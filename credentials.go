@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How long mock credentials are valid for, the same as real instance profile credentials at most
+const mockCredentialsLifetime = 6 * time.Hour
+
+// mockCredentials are the credentials served by mockRoleHandler
+type mockCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Token           string
+	LastUpdated     time.Time
+	Expiration      time.Time
+}
+
+// mockCredentialStore issues the mock credentials once and rotates them when they expire, or when a scenario
+// rotates them, numbering the new ones so clients can tell them apart
+type mockCredentialStore struct {
+	mu        sync.Mutex
+	current   *mockCredentials
+	rotations int
+}
+
+// get returns the credentials valid at now, issuing new ones if there are none yet, or none valid at now on a
+// clock advanced past their expiration or set back before they were issued
+func (s *mockCredentialStore) get(now time.Time) mockCredentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.current == nil:
+		s.current = newMockCredentials("", now)
+	case now.Before(s.current.LastUpdated) || !now.Before(s.current.Expiration):
+		s.rotateLocked(now)
+	}
+	return *s.current
+}
+
+// rotate replaces the credentials with new ones issued at now
+func (s *mockCredentialStore) rotate(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotateLocked(now)
+}
+
+func (s *mockCredentialStore) rotateLocked(now time.Time) {
+	s.rotations++
+	s.current = newMockCredentials(fmt.Sprintf("-%d", s.rotations), now)
+}
+
+// reset forgets the credentials, new ones are issued on the next get
+func (s *mockCredentialStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = nil
+	s.rotations = 0
+}
+
+func newMockCredentials(suffix string, now time.Time) *mockCredentials {
+	return &mockCredentials{
+		AccessKeyID:     "mock-access-key-id" + suffix,
+		SecretAccessKey: "mock-secret-access-key" + suffix,
+		Token:           "mock-token" + suffix,
+		LastUpdated:     now,
+		Expiration:      now.Add(mockCredentialsLifetime),
+	}
+}
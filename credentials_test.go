@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMockCredentialStore(t *testing.T) {
+	var s mockCredentialStore
+	now := time.Date(2018, 2, 26, 23, 50, 0, 0, time.UTC)
+	issued := s.get(now)
+	if issued.AccessKeyID != "mock-access-key-id" || !issued.LastUpdated.Equal(now) || !issued.Expiration.Equal(now.Add(6*time.Hour)) {
+		t.Errorf("Expected credentials issued now, valid for 6 hours, got %+v", issued)
+	}
+	if credentials := s.get(now.Add(6*time.Hour - time.Second)); credentials != issued {
+		t.Errorf("Expected the same credentials until they expire, got %+v", credentials)
+	}
+	if credentials := s.get(now.Add(6 * time.Hour)); credentials.AccessKeyID != "mock-access-key-id-1" ||
+		!credentials.LastUpdated.Equal(now.Add(6*time.Hour)) {
+		t.Errorf("Expected new credentials once expired, got %+v", credentials)
+	}
+	if credentials := s.get(now); credentials.AccessKeyID != "mock-access-key-id-2" {
+		t.Errorf("Expected new credentials on a clock set back before they were issued, got %+v", credentials)
+	}
+}
+
+func TestMockCredentialsExpireOnClock(t *testing.T) {
+	defer testApp.credentials.reset()
+	defer doAdminTest(t, "DELETE", "/clock", 200)
+	doAdminTest(t, "PUT", "/clock?frozen=true&now=2018-02-26T23:50:00Z", 200)
+
+	uri := "/latest/meta-data/iam/security-credentials/some-instance-profile"
+	issued := doGetBody(t, uri)
+	doAdminTest(t, "PUT", "/clock?advance=5h59m", 200)
+	if body := doGetBody(t, uri); body != issued {
+		t.Errorf("Expected the same credentials until they expire, got %s", body)
+	}
+	doAdminTest(t, "PUT", "/clock?advance=1m", 200)
+	body := doGetBody(t, uri)
+	if body == issued || !strings.Contains(body, `"LastUpdated" : "2018-02-27T05:50:00Z"`) ||
+		!strings.Contains(body, `"Expiration" : "2018-02-27T11:50:00Z"`) {
+		t.Errorf("Expected new credentials once expired, got %s", body)
+	}
+}
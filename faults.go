@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Fault is injected into the responses to requests matching Path (and Method, if set). Path is a path.Match
+// pattern, where * matches within a path segment, and a trailing ** matches the rest of the path.
+type Fault struct {
+	ID     int    `yaml:"-" json:"id"`
+	Path   string `yaml:"path" json:"path"`
+	Method string `yaml:"method" json:"method,omitempty"`
+	// When to inject the fault: only on the Nth matching request, at most Times times, and with the given
+	// probability. Each is ignored when zero, so a fault with none of them is injected into every match.
+	Nth         int     `yaml:"nth" json:"nth,omitempty"`
+	Times       int     `yaml:"times" json:"times,omitempty"`
+	Probability float64 `yaml:"probability" json:"probability,omitempty"`
+	// What to inject: a delay before responding, then either an error status, a dropped connection, or a
+	// body truncated to this many bytes
+	Latency  string `yaml:"latency" json:"latency,omitempty"`
+	Status   int    `yaml:"status" json:"status,omitempty"`
+	Drop     bool   `yaml:"drop" json:"drop,omitempty"`
+	Truncate *int   `yaml:"truncate" json:"truncate,omitempty"`
+	// Matching requests and faults injected so far
+	Matched  int `yaml:"-" json:"matched"`
+	Injected int `yaml:"-" json:"injected"`
+
+	latency time.Duration
+}
+
+func (f *Fault) validate() error {
+	if f.Path == "" {
+		return fmt.Errorf("fault path is required")
+	}
+	if err := validPathPattern(f.Path); err != nil {
+		return fmt.Errorf("invalid fault path %s: %+v", f.Path, err)
+	}
+	if f.Nth < 0 || f.Times < 0 || f.Probability < 0 || f.Probability > 1 {
+		return fmt.Errorf("invalid fault %s, nth and times must be positive and probability between 0 and 1", f.Path)
+	}
+	if f.Latency != "" {
+		latency, err := time.ParseDuration(f.Latency)
+		if err != nil || latency < 0 {
+			return fmt.Errorf("invalid fault latency %s", f.Latency)
+		}
+		f.latency = latency
+	}
+	if f.Status != 0 && (f.Status < 400 || f.Status > 599) {
+		return fmt.Errorf("invalid fault status %d, expected 4xx or 5xx", f.Status)
+	}
+	if f.Truncate != nil && *f.Truncate < 0 {
+		return fmt.Errorf("invalid fault truncate %d", *f.Truncate)
+	}
+	if f.latency == 0 && f.Status == 0 && !f.Drop && f.Truncate == nil {
+		return fmt.Errorf("fault %s has nothing to inject, expected latency, status, drop or truncate", f.Path)
+	}
+	return nil
+}
+
+func (f *Fault) matches(r *http.Request) bool {
+	if f.Method != "" && !strings.EqualFold(f.Method, r.Method) {
+		return false
+	}
+	return pathMatches(f.Path, r.URL.Path)
+}
+
+// validPathPattern checks a pattern for pathMatches
+func validPathPattern(pattern string) error {
+	_, err := path.Match(strings.TrimSuffix(pattern, "**"), "")
+	return err
+}
+
+// pathMatches matches p against a path.Match pattern, where a trailing ** matches the rest of the path
+func pathMatches(pattern string, p string) bool {
+	if prefix := strings.TrimSuffix(pattern, "**"); prefix != pattern {
+		return strings.HasPrefix(p, prefix)
+	}
+	matched, _ := path.Match(pattern, p)
+	return matched
+}
+
+// faultInjector holds the faults being injected, and counts the requests they match
+type faultInjector struct {
+	mu     sync.Mutex
+	faults []*Fault
+	nextID int
+}
+
+// add validates and adds faults, numbering them
+func (fi *faultInjector) add(faults ...*Fault) error {
+	for _, f := range faults {
+		if err := f.validate(); err != nil {
+			return err
+		}
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for _, f := range faults {
+		fi.nextID++
+		f.ID = fi.nextID
+		fi.faults = append(fi.faults, f)
+	}
+	return nil
+}
+
+// remove removes the fault with the given ID, or every fault when id is 0
+func (fi *faultInjector) remove(id int) bool {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if id == 0 {
+		fi.faults = nil
+		return true
+	}
+	for i, f := range fi.faults {
+		if f.ID == id {
+			fi.faults = append(fi.faults[:i], fi.faults[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// list returns copies of the faults
+func (fi *faultInjector) list() []Fault {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	faults := make([]Fault, 0, len(fi.faults))
+	for _, f := range fi.faults {
+		faults = append(faults, *f)
+	}
+	return faults
+}
+
+// next returns the first fault to inject into the response to r, if any, counting the faults it matches
+func (fi *faultInjector) next(r *http.Request) *Fault {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	var injected *Fault
+	for _, f := range fi.faults {
+		if !f.matches(r) {
+			continue
+		}
+		f.Matched++
+		if injected != nil ||
+			(f.Nth > 0 && f.Matched != f.Nth) ||
+			(f.Times > 0 && f.Injected >= f.Times) ||
+			(f.Probability > 0 && rand.Float64() >= f.Probability) {
+			continue
+		}
+		f.Injected++
+		injected = f
+	}
+	if injected == nil {
+		return nil
+	}
+	copied := *injected
+	return &copied
+}
+
+// truncatingWriter passes on the headers of a response, but only the first n bytes of its body
+type truncatingWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (tw *truncatingWriter) Write(b []byte) (int, error) {
+	if len(b) > tw.n {
+		b = b[:tw.n]
+	}
+	tw.n -= len(b)
+	return tw.ResponseWriter.Write(b)
+}
+
+// injectFaults delays, fails, drops or truncates the responses to requests matching the configured faults.
+// It wraps the other handlers, so the delay doesn't hold up the admin API and truncated responses still
+// announce their full Content-Length.
+func (app *App) injectFaults(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := app.faults.next(r)
+		if f == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		log.Infof("Injecting fault %d into %s %s", f.ID, r.Method, r.RequestURI)
+
+		if f.latency > 0 {
+			select {
+			case <-time.After(f.latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		switch {
+		case f.Drop:
+			panic(http.ErrAbortHandler)
+		case f.Status != 0:
+			app.imdsResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeError(w, f.Status)
+			})).ServeHTTP(w, r)
+		case f.Truncate != nil:
+			// The server closes the connection when less than the Content-Length was written
+			h.ServeHTTP(&truncatingWriter{ResponseWriter: w, n: *f.Truncate}, r)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
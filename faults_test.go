@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFaultMatches(t *testing.T) {
+	tests := []struct {
+		path     string
+		method   string
+		uri      string
+		expected bool
+	}{
+		{"/latest/meta-data/instance-id", "", "/latest/meta-data/instance-id", true},
+		{"/*/meta-data/instance-id", "", "/2016-09-02/meta-data/instance-id", true},
+		{"/latest/meta-data/*", "", "/latest/meta-data/iam/info", false},
+		{"/latest/meta-data/iam/**", "", "/latest/meta-data/iam/security-credentials/role", true},
+		{"/latest/api/token", "PUT", "/latest/api/token", true},
+		{"/latest/api/token", "GET", "/latest/api/token", false},
+	}
+	for _, test := range tests {
+		f := &Fault{Path: test.path, Method: test.method}
+		if got := f.matches(httptest.NewRequest("PUT", test.uri, nil)); got != test.expected {
+			t.Errorf("Fault %s %s matching PUT %s : Expected %v, got %v", test.method, test.path, test.uri, test.expected, got)
+		}
+	}
+}
+
+func TestFaultInjectorNext(t *testing.T) {
+	var fi faultInjector
+	if err := fi.add(&Fault{Path: "/latest/**", Nth: 2, Status: 500}, &Fault{Path: "/latest/**", Times: 2, Status: 503}); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/latest/meta-data/", nil)
+	var statuses []int
+	for i := 0; i < 4; i++ {
+		if f := fi.next(r); f != nil {
+			statuses = append(statuses, f.Status)
+		} else {
+			statuses = append(statuses, 200)
+		}
+	}
+	// The first matching fault wins, but both count the request
+	if statuses[0] != 503 || statuses[1] != 500 || statuses[2] != 503 || statuses[3] != 200 {
+		t.Errorf("Expected 503, 500, 503 then 200, got %v", statuses)
+	}
+
+	for _, f := range []*Fault{{}, {Path: "/latest/**"}, {Path: "/[", Drop: true}, {Path: "/", Status: 200},
+		{Path: "/", Latency: "soon"}, {Path: "/", Drop: true, Probability: 2}} {
+		if err := fi.add(f); err == nil {
+			t.Errorf("Expected an error for fault %+v", f)
+		}
+	}
+}
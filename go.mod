@@ -10,4 +10,6 @@ require (
 	github.com/gorilla/mux v1.7.4
 	github.com/jmespath/go-jmespath v0.3.0
 	github.com/spf13/pflag v1.0.5
+	go.mozilla.org/pkcs7 v0.10.0
+	gopkg.in/yaml.v2 v2.4.0
 )
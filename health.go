@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How long to wait between attempts at verifying the credentials backend
+const credentialsRetryInterval = 5 * time.Second
+
+// readiness tracks whether the server is ready to serve credentials, and why not
+type readiness struct {
+	mu       sync.Mutex
+	verified bool
+	reason   string
+	draining bool
+}
+
+func (rd *readiness) set(verified bool, reason string) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.verified = verified
+	rd.reason = reason
+}
+
+// drain marks the server as no longer ready, as it is shutting down
+func (rd *readiness) drain() {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.draining = true
+}
+
+// ready reports whether the server is ready, or the reason it isn't
+func (rd *readiness) ready() (bool, string) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	switch {
+	case rd.draining:
+		return false, "shutting down"
+	case !rd.verified && rd.reason == "":
+		return false, "verifying credentials"
+	}
+	return rd.verified, rd.reason
+}
+
+// verifyCredentials checks role credentials can be served, by getting them from STS unless they are mocked
+func (app *App) verifyCredentials() error {
+	app.mu.RLock()
+	mock, roleArn := app.MockInstanceProfile, app.roleArn()
+	app.mu.RUnlock()
+	if mock {
+		return nil
+	}
+	_, err := app.assumeRole(roleArn)
+	return err
+}
+
+// waitForCredentials verifies the credentials backend until it works, after which the server is ready
+func (app *App) waitForCredentials() {
+	for {
+		err := app.verifyCredentials()
+		if err == nil {
+			app.readiness.set(true, "")
+			log.Infof("Credentials verified, ready")
+			return
+		}
+		app.readiness.set(false, fmt.Sprintf("error verifying credentials: %+v", err))
+		log.Errorf("Error verifying credentials, retrying in %s: %+v", credentialsRetryInterval, err)
+		time.Sleep(credentialsRetryInterval)
+	}
+}
+
+// Always 200 while the server is running
+func (app *App) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	write(w, "ok")
+}
+
+// 200 once the credentials backend is verified, 503 with the reason before that and while shutting down
+func (app *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if ready, reason := app.readiness.ready(); !ready {
+		http.Error(w, reason, 503)
+		return
+	}
+	write(w, "ok")
+}
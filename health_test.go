@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	app := NewApp()
+	started := make(chan struct{})
+	s := app.newHTTPServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		write(w, "done")
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	bodies := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			bodies <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		bodies <- string(body)
+	}()
+	<-started
+	app.shutdown([]*http.Server{s}, nil)
+
+	if body := <-bodies; body != "done" {
+		t.Errorf("Expected the request in flight to complete, got %s", body)
+	}
+	if ready, reason := app.readiness.ready(); ready || reason != "shutting down" {
+		t.Errorf("Expected not ready while shutting down, got %v %s", ready, reason)
+	}
+	if _, err := http.Get("http://" + ln.Addr().String() + "/"); err == nil {
+		t.Errorf("Expected the server to have stopped accepting connections")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"go.mozilla.org/pkcs7"
+)
+
+// identitySigner signs instance identity documents the same way AWS does, but with a local
+// key and self-signed certificate standing in for the AWS regional certificates.
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/verify-signature.html
+type identitySigner struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+// loadIdentitySigner sets up the key and certificate used to sign instance identity documents.
+// If both IdentityKeyFile and IdentityCertFile exist they are used as is, if they are set but
+// missing a new pair is generated and written there, otherwise the current pair is kept (see
+// reload), or an ephemeral pair is generated.
+func (app *App) loadIdentitySigner() error {
+	if app.IdentityKeyFile == "" || app.IdentityCertFile == "" {
+		if app.IdentityKeyFile != "" || app.IdentityCertFile != "" {
+			return fmt.Errorf("both --identity-key-file and --identity-cert-file must be set")
+		}
+		if app.identitySigner != nil {
+			return nil
+		}
+		signer, err := generateIdentitySigner()
+		if err != nil {
+			return err
+		}
+		log.Infof("Generated an ephemeral instance identity certificate, served by the admin API at /certificate")
+		app.identitySigner = signer
+		return nil
+	}
+
+	_, keyErr := os.Stat(app.IdentityKeyFile)
+	_, certErr := os.Stat(app.IdentityCertFile)
+	if os.IsNotExist(keyErr) && os.IsNotExist(certErr) {
+		signer, err := generateIdentitySigner()
+		if err != nil {
+			return err
+		}
+		if err := signer.writeFiles(app.IdentityKeyFile, app.IdentityCertFile); err != nil {
+			return err
+		}
+		log.Infof("Generated instance identity certificate %s", app.IdentityCertFile)
+		app.identitySigner = signer
+		return nil
+	}
+
+	signer, err := readIdentitySigner(app.IdentityKeyFile, app.IdentityCertFile)
+	if err != nil {
+		return err
+	}
+	app.identitySigner = signer
+	return nil
+}
+
+func generateIdentitySigner() (*identitySigner, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("error generating identity key: %+v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, fmt.Errorf("error generating identity certificate serial: %+v", err)
+	}
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"aws-mock-metadata"},
+			CommonName:   "aws-mock-metadata instance identity",
+		},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating identity certificate: %+v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing identity certificate: %+v", err)
+	}
+	return &identitySigner{key: key, cert: cert}, nil
+}
+
+func readIdentitySigner(keyFile string, certFile string) (*identitySigner, error) {
+	keyBlock, err := readPEMFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var key *rsa.PrivateKey
+	switch keyBlock.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	default:
+		var parsed interface{}
+		parsed, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		if err == nil {
+			var ok bool
+			if key, ok = parsed.(*rsa.PrivateKey); !ok {
+				err = fmt.Errorf("not an RSA key")
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing identity key %s: %+v", keyFile, err)
+	}
+
+	cert, err := readCertificateFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	// Otherwise every signature fails to verify, and only the client finds out
+	if pub, ok := cert.PublicKey.(*rsa.PublicKey); !ok || pub.N.Cmp(key.N) != 0 || pub.E != key.E {
+		return nil, fmt.Errorf("identity certificate %s doesn't match the key %s", certFile, keyFile)
+	}
+	return &identitySigner{key: key, cert: cert}, nil
+}
+
+func readCertificateFile(certFile string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %+v", certFile, err)
+	}
+	return parseCertificatePEM(data, certFile)
+}
+
+// parseCertificatePEM parses a PEM certificate read from source
+func parseCertificatePEM(data []byte, source string) (*x509.Certificate, error) {
+	certBlock, _ := pem.Decode(data)
+	if certBlock == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", source)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing identity certificate %s: %+v", source, err)
+	}
+	return cert, nil
+}
+
+func readPEMFile(file string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %+v", file, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+	return block, nil
+}
+
+func (s *identitySigner) writeFiles(keyFile string, certFile string) error {
+	key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(s.key)})
+	if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		return fmt.Errorf("error writing identity key %s: %+v", keyFile, err)
+	}
+	if err := ioutil.WriteFile(certFile, s.certificatePEM(), 0644); err != nil {
+		return fmt.Errorf("error writing identity certificate %s: %+v", certFile, err)
+	}
+	return nil
+}
+
+func (s *identitySigner) certificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.cert.Raw})
+}
+
+// pkcs7 returns the PKCS#7 SignedData over document, with the content embedded like the real
+// service (so both `openssl smime -verify -content` and Vault style parsing work).
+func (s *identitySigner) pkcs7(document []byte) (string, error) {
+	sd, err := pkcs7.NewSignedData(document)
+	if err != nil {
+		return "", err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSigner(s.cert, s.key, pkcs7.SignerInfoConfig{}); err != nil {
+		return "", err
+	}
+	der, err := sd.Finish()
+	if err != nil {
+		return "", err
+	}
+	return wrapBase64(der), nil
+}
+
+// signature returns the base64 encoded RSA-SHA256 signature over document.
+func (s *identitySigner) signature(document []byte) (string, error) {
+	digest := sha256.Sum256(document)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return wrapBase64(sig), nil
+}
+
+// verifyIdentityPkcs7 checks a PKCS#7 signature against cert the way Vault does, by
+// swapping in cert as the only candidate signer. If document is not nil it must match
+// the signed content. The signed content is returned.
+func verifyIdentityPkcs7(cert *x509.Certificate, document []byte, signature []byte) ([]byte, error) {
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing PKCS#7 signature: %+v", err)
+	}
+	if document != nil {
+		if len(p7.Content) == 0 {
+			p7.Content = document
+		} else if string(p7.Content) != string(document) {
+			return p7.Content, fmt.Errorf("signed content does not match the document")
+		}
+	}
+	p7.Certificates = []*x509.Certificate{cert}
+	if err := p7.Verify(); err != nil {
+		return p7.Content, err
+	}
+	return p7.Content, nil
+}
+
+// verifyIdentitySignature checks an RSA-SHA256 signature of document against cert.
+func verifyIdentitySignature(cert *x509.Certificate, document []byte, signature []byte) error {
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("certificate does not hold an RSA public key")
+	}
+	digest := sha256.Sum256(document)
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+}
+
+// decodeBase64Signature undoes wrapBase64, also accepting PEM armoured input.
+func decodeBase64Signature(data []byte) ([]byte, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+}
+
+// wrapBase64 encodes data as base64 split over 64 character lines, without PEM armour,
+// which is how the metadata service returns signatures.
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	lines := make([]string, 0, len(encoded)/64+1)
+	for len(encoded) > 64 {
+		lines = append(lines, encoded[:64])
+		encoded = encoded[64:]
+	}
+	lines = append(lines, encoded)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadIdentitySignerMismatch(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{"unused": ""})
+	defer cleanup()
+	dir := filepath.Dir(paths["unused"])
+	for _, name := range []string{"a", "b"} {
+		signer, err := generateIdentitySigner()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := signer.writeFiles(filepath.Join(dir, name+".key"), filepath.Join(dir, name+".pem")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := NewApp()
+	app.IdentityKeyFile, app.IdentityCertFile = filepath.Join(dir, "a.key"), filepath.Join(dir, "a.pem")
+	if err := app.loadIdentitySigner(); err != nil {
+		t.Errorf("Expected a matching key and certificate to be loaded, got %+v", err)
+	}
+	app = NewApp()
+	app.IdentityKeyFile, app.IdentityCertFile = filepath.Join(dir, "a.key"), filepath.Join(dir, "b.pem")
+	if err := app.loadIdentitySigner(); err == nil {
+		t.Errorf("Expected a certificate for another key to be rejected")
+	}
+}
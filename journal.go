@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JournalEntry is a request the metadata server received, as recorded in the journal
+type JournalEntry struct {
+	Time    string      `json:"time"`
+	Client  string      `json:"client"`
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Headers http.Header `json:"headers"`
+	// Whether the request had an X-aws-ec2-metadata-token, and the IMDS version it used, see imdsVersion
+	Token       bool   `json:"token"`
+	ImdsVersion string `json:"imds-version"`
+	// 0 when the connection was dropped
+	Status int `json:"status"`
+}
+
+// JournalQuery selects journal entries, each field is ignored when empty. Path is a pattern like a Fault's.
+type JournalQuery struct {
+	Method      string
+	Path        string
+	Client      string
+	ImdsVersion string
+	Status      int
+}
+
+func (q JournalQuery) matches(e *JournalEntry) bool {
+	return (q.Method == "" || strings.EqualFold(q.Method, e.Method)) &&
+		(q.Path == "" || pathMatches(q.Path, e.Path)) &&
+		(q.Client == "" || q.Client == e.Client) &&
+		(q.ImdsVersion == "" || q.ImdsVersion == e.ImdsVersion) &&
+		(q.Status == 0 || q.Status == e.Status)
+}
+
+// requestJournal holds the most recent requests, up to size
+type requestJournal struct {
+	mu      sync.Mutex
+	entries []JournalEntry
+}
+
+// record adds an entry, forgetting the oldest ones once the journal holds twice size
+func (j *requestJournal) record(e JournalEntry, size int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, e)
+	if len(j.entries) > 2*size {
+		j.entries = append([]JournalEntry(nil), j.entries[len(j.entries)-size:]...)
+	}
+}
+
+// query returns the entries matching q among the size most recent ones, oldest first
+func (j *requestJournal) query(q JournalQuery, size int) []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := j.entries
+	if len(entries) > size {
+		entries = entries[len(entries)-size:]
+	}
+	matching := []JournalEntry{}
+	for i := range entries {
+		if q.matches(&entries[i]) {
+			matching = append(matching, entries[i])
+		}
+	}
+	return matching
+}
+
+func (j *requestJournal) reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = nil
+}
+
+// parseJournalQuery reads a JournalQuery from the ?method=, ?path=, ?client=, ?imds-version= and ?status= given
+func parseJournalQuery(r *http.Request) (JournalQuery, error) {
+	query := r.URL.Query()
+	q := JournalQuery{
+		Method:      query.Get("method"),
+		Path:        query.Get("path"),
+		Client:      query.Get("client"),
+		ImdsVersion: query.Get("imds-version"),
+	}
+	if err := validPathPattern(q.Path); err != nil {
+		return q, fmt.Errorf("invalid path %s: %+v", q.Path, err)
+	}
+	if q.ImdsVersion != "" && q.ImdsVersion != "v1" && q.ImdsVersion != "v2" {
+		return q, fmt.Errorf("invalid imds-version %s, expected v1 or v2", q.ImdsVersion)
+	}
+	if v := query.Get("status"); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid status %s", v)
+		}
+		q.Status = status
+	}
+	return q, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRequestJournal(t *testing.T) {
+	var j requestJournal
+	for i := 0; i < 25; i++ {
+		j.record(JournalEntry{Method: "GET", Path: fmt.Sprintf("/latest/meta-data/%d", i), Status: 200}, 10)
+	}
+	entries := j.query(JournalQuery{}, 10)
+	if len(entries) != 10 || entries[0].Path != "/latest/meta-data/15" || entries[9].Path != "/latest/meta-data/24" {
+		t.Errorf("Expected the 10 most recent requests, oldest first, got %+v", entries)
+	}
+	if entries := j.query(JournalQuery{Path: "/latest/meta-data/2*"}, 10); len(entries) != 5 {
+		t.Errorf("Expected 5 requests matching /latest/meta-data/2*, got %+v", entries)
+	}
+	if entries := j.query(JournalQuery{Method: "PUT"}, 10); len(entries) != 0 {
+		t.Errorf("Expected no PUT requests, got %+v", entries)
+	}
+	j.reset()
+	if entries := j.query(JournalQuery{}, 10); len(entries) != 0 {
+		t.Errorf("Expected an empty journal after reset, got %+v", entries)
+	}
+}
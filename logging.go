@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// loggingConfig is the logging set up by configureLogging
+type loggingConfig struct {
+	level  log.Level
+	format string
+	output string
+	// Open while output is a file
+	file *os.File
+}
+
+// configureLogging sets up the log level, format and output of params, --verbose being short for --log-level debug.
+// Only what changed since the last call is applied: logrus reads the level and formatter without locking, and the
+// output file is kept open until the output changes.
+func (app *App) configureLogging(params *App) error {
+	level, err := log.ParseLevel(params.LogLevel)
+	if err != nil {
+		return fmt.Errorf("invalid log level %s, expected debug, info, warn or error", params.LogLevel)
+	}
+	if params.Verbose {
+		level = log.DebugLevel
+	}
+
+	var formatter log.Formatter
+	switch params.LogFormat {
+	case "text":
+		formatter = &log.TextFormatter{}
+	case "logfmt":
+		formatter = &log.TextFormatter{DisableColors: true}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid log format %s, expected text, logfmt or json", params.LogFormat)
+	}
+
+	current := app.logging
+	next := &loggingConfig{level: level, format: params.LogFormat, output: params.LogOutput}
+	var output io.Writer
+	switch {
+	case current != nil && current.output == next.output:
+		next.file = current.file
+	case next.output == "stderr":
+		output = os.Stderr
+	case next.output == "stdout":
+		output = os.Stdout
+	default:
+		f, err := os.OpenFile(next.output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening log output: %+v", err)
+		}
+		next.file = f
+		output = f
+	}
+
+	if current == nil || current.level != next.level {
+		log.SetLevel(next.level)
+	}
+	if current == nil || current.format != next.format {
+		log.SetFormatter(formatter)
+	}
+	if output != nil {
+		log.SetOutput(output)
+		if current != nil && current.file != nil {
+			current.file.Close()
+		}
+	}
+	app.logging = next
+	return nil
+}
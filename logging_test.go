@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestAccessLog(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{"access.log": ""})
+	defer cleanup()
+	app := NewApp()
+	app.LogFormat = "json"
+	app.LogOutput = paths["access.log"]
+	if err := app.configureLogging(app); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		log.SetFormatter(&log.TextFormatter{})
+		log.SetOutput(os.Stderr)
+	}()
+
+	doNotFoundTest(t, "GET", "/latest/meta-data/unknown")
+	data, err := ioutil.ReadFile(paths["access.log"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &entry); err != nil {
+		t.Fatalf("Expected a JSON access log entry, got %s: %+v", data, err)
+	}
+	for field, expected := range map[string]interface{}{
+		"msg":          "access",
+		"client":       "127.0.0.1",
+		"method":       "GET",
+		"path":         "/latest/meta-data/unknown",
+		"route":        "",
+		"status":       float64(404),
+		"imds_version": "v1",
+	} {
+		if entry[field] != expected {
+			t.Errorf("Expected access log %s %v, got %v", field, expected, entry[field])
+		}
+	}
+	if bytes, _ := entry["bytes"].(float64); bytes <= 0 {
+		t.Errorf("Expected the size of the error page, got %v", entry["bytes"])
+	}
+	if _, ok := entry["duration"].(float64); !ok {
+		t.Errorf("Expected a duration in seconds, got %v", entry["duration"])
+	}
+}
+
+func TestConfigureLoggingErrors(t *testing.T) {
+	for _, app := range []*App{{LogLevel: "loud", LogFormat: "text", LogOutput: "stderr"},
+		{LogLevel: "info", LogFormat: "xml", LogOutput: "stderr"}} {
+		if err := app.configureLogging(app); err == nil {
+			t.Errorf("Expected an error configuring logging %s %s", app.LogLevel, app.LogFormat)
+		}
+	}
+}
+
+func TestConfigureLoggingKeepsFile(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{"a.log": "", "b.log": ""})
+	defer cleanup()
+	defer log.SetOutput(os.Stderr)
+	app := NewApp()
+	app.LogOutput = paths["a.log"]
+	if err := app.configureLogging(app); err != nil {
+		t.Fatal(err)
+	}
+	file := app.logging.file
+
+	if err := app.configureLogging(app); err != nil {
+		t.Fatal(err)
+	}
+	if app.logging.file != file {
+		t.Errorf("Expected the log file to be kept open when the output is unchanged")
+	}
+
+	app.LogOutput = paths["b.log"]
+	if err := app.configureLogging(app); err != nil {
+		t.Fatal(err)
+	}
+	if app.logging.file == file || app.logging.file.Name() != paths["b.log"] {
+		t.Errorf("Expected the new log file, got %s", app.logging.file.Name())
+	}
+	if _, err := file.Write([]byte("closed?\n")); err == nil {
+		t.Errorf("Expected the previous log file to be closed")
+	}
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"io/ioutil"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
 // Not a fan of globals, but it's the only sane way to pass an httptest instance into each of the tests...
 var (
-	testServer *httptest.Server
+	testApp         *App
+	testServer      *httptest.Server
+	testAdminServer *httptest.Server
 )
 
 func TestMain(m *testing.M) {
 	// Setup the test API
-	app := &App{}
+	app := NewApp()
+	testApp = app
 	// Mock parameters
 	app.AmiID = "ami-asdfasdf"
 	app.AvailabilityZone = "us-east-1a"
@@ -28,9 +33,65 @@ func TestMain(m *testing.M) {
 	app.RoleName = "some-instance-profile"
 	// No RoleArn or RoleName needed for current test coverage
 	app.VpcID = "vpc-asdfasdf"
+	app.Tags = map[string]string{"Name": "test-instance", "Environment": "test"}
+	app.InstanceMetadataTags = true
+	app.BlockDeviceMappings = map[string]string{"ephemeral0": "/dev/sdb", "ebs1": "/dev/xvdf"}
+	app.PublicKeys = []PublicKey{{Name: "test-key", OpensshKey: "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQ test-key"}}
+	app.NetworkInterfaces = []*NetworkInterface{
+		{
+			Mac:                  "0e:11:22:33:44:55",
+			DeviceNumber:         1,
+			InterfaceID:          "eni-qwerqwer",
+			LocalIpv4s:           []string{"10.20.31.10", "10.20.31.11"},
+			SecurityGroups:       []string{"secondary"},
+			SecurityGroupIDs:     []string{"sg-qwerqwer"},
+			SubnetID:             "subnet-qwerqwer",
+			SubnetIpv4CidrBlock:  "10.20.31.0/24",
+			VpcID:                "vpc-asdfasdf",
+			VpcIpv4CidrBlocks:    []string{"10.20.0.0/16", "100.64.0.0/16"},
+			Ipv6s:                []string{"2600:1f18:aaaa:bb31::10"},
+			SubnetIpv6CidrBlocks: []string{"2600:1f18:aaaa:bb31::/64"},
+			VpcIpv6CidrBlocks:    []string{"2600:1f18:aaaa:bb00::/56"},
+		},
+		{
+			Mac:                 "00:aa:bb:cc:dd:ee",
+			InterfaceID:         "eni-asdfasdf",
+			LocalHostname:       "testhostname",
+			LocalIpv4s:          []string{"10.20.30.40"},
+			Ipv4Associations:    map[string]string{"54.10.20.30": "10.20.30.40"},
+			SecurityGroups:      []string{"default"},
+			SecurityGroupIDs:    []string{"sg-asdfasdf"},
+			SubnetID:            "subnet-asdfasdf",
+			SubnetIpv4CidrBlock: "10.20.30.0/24",
+			VpcID:               "vpc-asdfasdf",
+			VpcIpv4CidrBlocks:   []string{"10.20.0.0/16"},
+		},
+	}
+	app.LaunchTime = "2016-04-15T12:14:15Z"
+	if err := app.prepare(); err != nil {
+		panic(err)
+	}
 	testServer = httptest.NewServer(app.NewServer())
 	defer testServer.Close()
+	testAdminServer = httptest.NewServer(app.NewAdminServer())
+	defer testAdminServer.Close()
 
 	// Run the tests
 	os.Exit(m.Run())
 }
+
+// Writes the given files into a temporary directory, returning their paths by name
+func writeTempFiles(t *testing.T, files map[string]string) (map[string]string, func()) {
+	dir, err := ioutil.TempDir("", "aws-mock-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]string{}
+	for name, contents := range files {
+		paths[name] = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(paths[name], []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths, func() { os.RemoveAll(dir) }
+}
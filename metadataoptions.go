@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MetadataOptions are the instance's ModifyInstanceMetadataOptions settings, as shown by the admin API
+type MetadataOptions struct {
+	HttpEndpoint            string `json:"http-endpoint"`
+	HttpPutResponseHopLimit int    `json:"http-put-response-hop-limit"`
+	HttpProtocolIpv6        string `json:"http-protocol-ipv6"`
+}
+
+func (app *App) metadataOptions() MetadataOptions {
+	return MetadataOptions{
+		HttpEndpoint:            app.HttpEndpoint,
+		HttpPutResponseHopLimit: app.HttpPutResponseHopLimit,
+		HttpProtocolIpv6:        app.HttpProtocolIpv6,
+	}
+}
+
+func (o MetadataOptions) validate() error {
+	if o.HttpEndpoint != "enabled" && o.HttpEndpoint != "disabled" {
+		return fmt.Errorf("invalid http-endpoint %s, expected enabled or disabled", o.HttpEndpoint)
+	}
+	if o.HttpPutResponseHopLimit < 1 || o.HttpPutResponseHopLimit > 64 {
+		return fmt.Errorf("invalid http-put-response-hop-limit %d, expected 1 to 64", o.HttpPutResponseHopLimit)
+	}
+	if o.HttpProtocolIpv6 != "enabled" && o.HttpProtocolIpv6 != "disabled" {
+		return fmt.Errorf("invalid http-protocol-ipv6 %s, expected enabled or disabled", o.HttpProtocolIpv6)
+	}
+	return nil
+}
+
+func (app *App) prepareMetadataOptions() error {
+	if err := app.metadataOptions().validate(); err != nil {
+		return err
+	}
+	app.containerNets = nil
+	for _, cidr := range app.ContainerCidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid container cidr %s: %+v", cidr, err)
+		}
+		app.containerNets = append(app.containerNets, n)
+	}
+	return nil
+}
+
+// clientHops returns how many network hops away the client is. Clients in ContainerCidrs are behind a
+// container bridge, one hop further than processes on the instance itself.
+func (app *App) clientHops(r *http.Request) int {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, n := range app.containerNets {
+		if n.Contains(ip) {
+			return 2
+		}
+	}
+	return 1
+}
+
+// isIpv6Request reports whether the request came in on an IPv6 listener, e.g. fd00:ec2::254
+func isIpv6Request(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// enforceMetadataOptions drops the connection, without a response, when the endpoint (or its IPv6 address) is
+// disabled, and for token PUTs from clients further away than the hop limit. On EC2 the response to those never
+// arrives, as its TTL runs out on the way, so clients time out instead.
+func (app *App) enforceMetadataOptions(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.mu.RLock()
+		options := app.metadataOptions()
+		hops := app.clientHops(r)
+		app.mu.RUnlock()
+
+		switch {
+		case options.HttpEndpoint == "disabled":
+			log.Infof("Dropping %s %s, the metadata endpoint is disabled", r.Method, r.RequestURI)
+		case options.HttpProtocolIpv6 == "disabled" && isIpv6Request(r):
+			log.Infof("Dropping %s %s, the IPv6 metadata endpoint is disabled", r.Method, r.RequestURI)
+		case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/api/token") && hops > options.HttpPutResponseHopLimit:
+			log.Infof("Dropping %s %s from %s, %d hops away with a hop limit of %d", r.Method, r.RequestURI,
+				r.RemoteAddr, hops, options.HttpPutResponseHopLimit)
+		default:
+			h.ServeHTTP(w, r)
+			return
+		}
+		panic(http.ErrAbortHandler)
+	})
+}
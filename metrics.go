@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, of the request duration histogram buckets
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type requestKey struct {
+	template    string
+	status      int
+	imdsVersion string
+}
+
+// histogram counts observations into durationBuckets, the last count being the +Inf bucket
+type histogram struct {
+	counts []int64
+	sum    float64
+}
+
+// metrics holds the counters served in the Prometheus text format by the admin API's /metrics
+type metrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]int64
+	durations map[string]*histogram
+	stsCalls  int64
+	stsErrors int64
+	// LastUpdated of the credentials served most recently
+	credentialsUpdated time.Time
+}
+
+// observe counts a served request, by the route it matched (empty when it matched none), status and IMDS version
+func (m *metrics) observe(template string, status int, imdsVersion string, d time.Duration) {
+	if template == "" {
+		template = "unmatched"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = map[requestKey]int64{}
+		m.durations = map[string]*histogram{}
+	}
+	m.requests[requestKey{template, status, imdsVersion}]++
+
+	h, ok := m.durations[template]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(durationBuckets)+1)}
+		m.durations[template] = h
+	}
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(durationBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+}
+
+// stsCall counts a call to STS AssumeRole, and whether it failed
+func (m *metrics) stsCall(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stsCalls++
+	if err != nil {
+		m.stsErrors++
+	}
+}
+
+func (m *metrics) credentialsServed(lastUpdated time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.credentialsUpdated = lastUpdated
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name="value" pairs as a Prometheus label set
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func writeMetricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// write writes the metrics in the Prometheus text exposition format, sorted by label values
+func (m *metrics) write(w io.Writer, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.template != b.template {
+			return a.template < b.template
+		}
+		if a.status != b.status {
+			return a.status < b.status
+		}
+		return a.imdsVersion < b.imdsVersion
+	})
+	writeMetricHeader(w, "imds_requests_total", "counter", "Requests served, by route, status (0 for dropped connections) and IMDS version.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "imds_requests_total%s %d\n",
+			labels("path", key.template, "status", strconv.Itoa(key.status), "imds_version", key.imdsVersion), m.requests[key])
+	}
+
+	templates := make([]string, 0, len(m.durations))
+	for template := range m.durations {
+		templates = append(templates, template)
+	}
+	sort.Strings(templates)
+	writeMetricHeader(w, "imds_request_duration_seconds", "histogram", "Time taken to serve requests, by route.")
+	for _, template := range templates {
+		h := m.durations[template]
+		var count int64
+		for i, bound := range durationBuckets {
+			count += h.counts[i]
+			fmt.Fprintf(w, "imds_request_duration_seconds_bucket%s %d\n", labels("path", template, "le", formatFloat(bound)), count)
+		}
+		count += h.counts[len(durationBuckets)]
+		fmt.Fprintf(w, "imds_request_duration_seconds_bucket%s %d\n", labels("path", template, "le", "+Inf"), count)
+		fmt.Fprintf(w, "imds_request_duration_seconds_sum%s %s\n", labels("path", template), formatFloat(h.sum))
+		fmt.Fprintf(w, "imds_request_duration_seconds_count%s %d\n", labels("path", template), count)
+	}
+
+	writeMetricHeader(w, "imds_sts_assume_role_calls_total", "counter", "Calls to STS AssumeRole for role credentials.")
+	fmt.Fprintf(w, "imds_sts_assume_role_calls_total %d\n", m.stsCalls)
+	writeMetricHeader(w, "imds_sts_assume_role_errors_total", "counter", "Calls to STS AssumeRole that failed.")
+	fmt.Fprintf(w, "imds_sts_assume_role_errors_total %d\n", m.stsErrors)
+	if !m.credentialsUpdated.IsZero() {
+		writeMetricHeader(w, "imds_credentials_age_seconds", "gauge", "Time since the credentials served most recently were last updated.")
+		fmt.Fprintf(w, "imds_credentials_age_seconds %s\n", formatFloat(now.Sub(m.credentialsUpdated).Seconds()))
+	}
+}
+
+// writeMetrics writes the request metrics, followed by the gauges read from the rest of the server's state
+func (app *App) writeMetrics(w io.Writer) {
+	now := app.clock.now()
+	app.metrics.write(w, now)
+
+	writeMetricHeader(w, "imds_active_tokens", "gauge", "IMDSv2 session tokens issued that have not expired.")
+	fmt.Fprintf(w, "imds_active_tokens %d\n", app.tokens.active(now))
+
+	counters := app.limiter.counters()
+	clients := make([]string, 0, len(counters))
+	for client := range counters {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	writeMetricHeader(w, "imds_client_requests_total", "counter", "Requests made, by client IP.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "imds_client_requests_total%s %d\n", labels("client", client), counters[client].Requests)
+	}
+	writeMetricHeader(w, "imds_client_throttled_total", "counter", "Requests throttled by the rate limit, by client IP.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "imds_client_throttled_total%s %d\n", labels("client", client), counters[client].Throttled)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	var m metrics
+	m.observe("/{version}/meta-data/instance-id", 200, "v1", 2*time.Millisecond)
+	m.observe("/{version}/meta-data/instance-id", 200, "v1", 20*time.Millisecond)
+	m.observe("", 404, "v2", 10*time.Second)
+	m.stsCall(nil)
+	m.stsCall(errors.New("AccessDenied"))
+	updated := time.Date(2018, 2, 26, 23, 50, 0, 0, time.UTC)
+	m.credentialsServed(updated)
+
+	var b strings.Builder
+	m.write(&b, updated.Add(90*time.Second))
+	for _, expected := range []string{
+		"# TYPE imds_requests_total counter\n" +
+			`imds_requests_total{path="/{version}/meta-data/instance-id",status="200",imds_version="v1"} 2` + "\n" +
+			`imds_requests_total{path="unmatched",status="404",imds_version="v2"} 1` + "\n",
+		`imds_request_duration_seconds_bucket{path="/{version}/meta-data/instance-id",le="0.001"} 0` + "\n" +
+			`imds_request_duration_seconds_bucket{path="/{version}/meta-data/instance-id",le="0.005"} 1` + "\n" +
+			`imds_request_duration_seconds_bucket{path="/{version}/meta-data/instance-id",le="0.01"} 1` + "\n" +
+			`imds_request_duration_seconds_bucket{path="/{version}/meta-data/instance-id",le="0.05"} 2` + "\n",
+		`imds_request_duration_seconds_bucket{path="unmatched",le="5"} 0` + "\n" +
+			`imds_request_duration_seconds_bucket{path="unmatched",le="+Inf"} 1` + "\n" +
+			`imds_request_duration_seconds_sum{path="unmatched"} 10` + "\n" +
+			`imds_request_duration_seconds_count{path="unmatched"} 1` + "\n",
+		"imds_sts_assume_role_calls_total 2\n",
+		"imds_sts_assume_role_errors_total 1\n",
+		"imds_credentials_age_seconds 90\n",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("Expected metrics to contain\n%s\ngot\n%s", expected, b.String())
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	if got := labels("path", `/a"b\c`, "status", "200"); got != `{path="/a\"b\\c",status="200"}` {
+		t.Errorf("Expected escaped labels, got %s", got)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NetworkInterface is an ENI attached to the instance, served under network/interfaces/macs/<mac>/
+type NetworkInterface struct {
+	Mac           string `yaml:"mac" json:"mac,omitempty"`
+	DeviceNumber  int    `yaml:"device-number" json:"device-number"`
+	InterfaceID   string `yaml:"interface-id" json:"interface-id,omitempty"`
+	LocalHostname string `yaml:"local-hostname" json:"local-hostname,omitempty"`
+	// The primary private IP first, followed by the secondary private IPs
+	LocalIpv4s          []string `yaml:"local-ipv4s" json:"local-ipv4s,omitempty"`
+	OwnerID             string   `yaml:"owner-id" json:"owner-id,omitempty"`
+	SecurityGroups      []string `yaml:"security-groups" json:"security-groups,omitempty"`
+	SecurityGroupIDs    []string `yaml:"security-group-ids" json:"security-group-ids,omitempty"`
+	SubnetID            string   `yaml:"subnet-id" json:"subnet-id,omitempty"`
+	SubnetIpv4CidrBlock string   `yaml:"subnet-ipv4-cidr-block" json:"subnet-ipv4-cidr-block,omitempty"`
+	VpcID               string   `yaml:"vpc-id" json:"vpc-id,omitempty"`
+	VpcIpv4CidrBlocks   []string `yaml:"vpc-ipv4-cidr-blocks" json:"vpc-ipv4-cidr-blocks,omitempty"`
+	// IPv6 keys are only listed when the interface has IPv6 addresses
+	Ipv6s                []string `yaml:"ipv6s" json:"ipv6s,omitempty"`
+	SubnetIpv6CidrBlocks []string `yaml:"subnet-ipv6-cidr-blocks" json:"subnet-ipv6-cidr-blocks,omitempty"`
+	VpcIpv6CidrBlocks    []string `yaml:"vpc-ipv6-cidr-blocks" json:"vpc-ipv6-cidr-blocks,omitempty"`
+	// Public (or Elastic) IPs keyed by public IP, mapping to the private IP they are associated with.
+	// The public keys are only listed when the interface has at least one.
+	Ipv4Associations map[string]string `yaml:"ipv4-associations" json:"ipv4-associations,omitempty"`
+	// Defaults to the EC2 public DNS name of the first public IP
+	PublicHostname string `yaml:"public-hostname" json:"public-hostname,omitempty"`
+}
+
+// prepareNetworkInterfaces fills in NetworkInterfaces from the primary interface flags when
+// it is not configured, and defaults the per interface fields that can be derived.
+func (app *App) prepareNetworkInterfaces() error {
+	if len(app.NetworkInterfaces) == 0 && app.MacAddress != "" {
+		eni := &NetworkInterface{
+			Mac:                 app.MacAddress,
+			InterfaceID:         app.InterfaceID,
+			LocalHostname:       app.Hostname,
+			SubnetID:            app.SubnetID,
+			SubnetIpv4CidrBlock: app.SubnetIpv4CidrBlock,
+			VpcID:               app.VpcID,
+		}
+		if app.PrivateIp != "" {
+			eni.LocalIpv4s = []string{app.PrivateIp}
+		}
+		if app.VpcIpv4CidrBlock != "" {
+			eni.VpcIpv4CidrBlocks = []string{app.VpcIpv4CidrBlock}
+		}
+		if app.Ipv6 != "" {
+			eni.Ipv6s = []string{app.Ipv6}
+		}
+		if app.SubnetIpv6CidrBlock != "" {
+			eni.SubnetIpv6CidrBlocks = []string{app.SubnetIpv6CidrBlock}
+		}
+		if app.VpcIpv6CidrBlock != "" {
+			eni.VpcIpv6CidrBlocks = []string{app.VpcIpv6CidrBlock}
+		}
+		if app.PublicIpv4 != "" {
+			eni.Ipv4Associations = map[string]string{app.PublicIpv4: app.PrivateIp}
+		}
+		eni.PublicHostname = app.PublicHostname
+		app.NetworkInterfaces = []*NetworkInterface{eni}
+	}
+
+	macs := map[string]bool{}
+	devices := map[int]bool{}
+	publicIps := map[string]bool{}
+	for _, eni := range app.NetworkInterfaces {
+		if eni.Mac == "" {
+			return fmt.Errorf("network interface %d has no mac", eni.DeviceNumber)
+		}
+		eni.Mac = strings.ToLower(eni.Mac)
+		if macs[eni.Mac] {
+			return fmt.Errorf("duplicate network interface mac %s", eni.Mac)
+		}
+		if devices[eni.DeviceNumber] {
+			return fmt.Errorf("duplicate network interface device-number %d", eni.DeviceNumber)
+		}
+		macs[eni.Mac] = true
+		devices[eni.DeviceNumber] = true
+		for publicIp, privateIp := range eni.Ipv4Associations {
+			if publicIps[publicIp] {
+				return fmt.Errorf("public ip %s is associated with more than one network interface", publicIp)
+			}
+			if !eni.hasPrivateIp(privateIp) {
+				return fmt.Errorf("public ip %s is associated with %s, which is not a private ip of %s", publicIp, privateIp, eni.Mac)
+			}
+			publicIps[publicIp] = true
+		}
+
+		if eni.InterfaceID == "" {
+			eni.InterfaceID = "eni-" + strings.Replace(eni.Mac, ":", "", -1)
+		}
+		if eni.OwnerID == "" {
+			eni.OwnerID = app.AccountID
+		}
+		if eni.LocalHostname == "" && len(eni.LocalIpv4s) > 0 {
+			eni.LocalHostname = app.privateDNSName(eni.LocalIpv4s[0])
+		}
+	}
+	sort.Slice(app.NetworkInterfaces, func(i, j int) bool {
+		return app.NetworkInterfaces[i].DeviceNumber < app.NetworkInterfaces[j].DeviceNumber
+	})
+	return nil
+}
+
+// privateDNSName returns the EC2 private DNS name for an IP, e.g. ip-10-0-0-1.ec2.internal
+func (app *App) privateDNSName(ip string) string {
+	name := "ip-" + strings.Replace(ip, ".", "-", -1)
+	if region := app.region(); region != "us-east-1" && region != "" {
+		return name + "." + region + ".compute.internal"
+	}
+	return name + ".ec2.internal"
+}
+
+// primaryNetworkInterface returns the interface with the lowest device number, normally eth0
+func (app *App) primaryNetworkInterface() *NetworkInterface {
+	if len(app.NetworkInterfaces) == 0 {
+		return nil
+	}
+	return app.NetworkInterfaces[0]
+}
+
+func (app *App) networkInterface(mac string) *NetworkInterface {
+	for _, eni := range app.NetworkInterfaces {
+		if eni.Mac == strings.ToLower(mac) {
+			return eni
+		}
+	}
+	return nil
+}
+
+// primaryMac and primaryPrivateIp back the top level mac and local-ipv4 keys
+func (app *App) primaryMac() string {
+	if eni := app.primaryNetworkInterface(); eni != nil {
+		return eni.Mac
+	}
+	return app.MacAddress
+}
+
+func (app *App) primaryPrivateIp() string {
+	if eni := app.primaryNetworkInterface(); eni != nil && len(eni.LocalIpv4s) > 0 {
+		return eni.LocalIpv4s[0]
+	}
+	return app.PrivateIp
+}
+
+// primaryPublicIpv4 backs the top level public-ipv4 key, which only exists when the primary interface has a public IP
+func (app *App) primaryPublicIpv4() string {
+	if eni := app.primaryNetworkInterface(); eni != nil {
+		if publicIps := eni.publicIpv4s(); len(publicIps) > 0 {
+			return publicIps[0]
+		}
+	}
+	return ""
+}
+
+// primaryPublicHostname backs the top level public-hostname key
+func (app *App) primaryPublicHostname() string {
+	if eni := app.primaryNetworkInterface(); eni != nil {
+		return app.publicHostname(eni)
+	}
+	return ""
+}
+
+// publicHostname returns the interface's public DNS name, e.g. ec2-54-1-2-3.compute-1.amazonaws.com
+func (app *App) publicHostname(eni *NetworkInterface) string {
+	if eni.PublicHostname != "" {
+		return eni.PublicHostname
+	}
+	publicIps := eni.publicIpv4s()
+	if len(publicIps) == 0 {
+		return ""
+	}
+	name := "ec2-" + strings.Replace(publicIps[0], ".", "-", -1)
+	if region := app.region(); region != "us-east-1" && region != "" {
+		return name + "." + region + ".compute." + app.serviceDomain()
+	}
+	return name + ".compute-1." + app.serviceDomain()
+}
+
+func (eni *NetworkInterface) hasPrivateIp(ip string) bool {
+	for _, privateIp := range eni.LocalIpv4s {
+		if privateIp == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// publicIpv4s returns the interface's public IPs, in the order of the private IPs they are associated with
+func (eni *NetworkInterface) publicIpv4s() []string {
+	publicIps := make([]string, 0, len(eni.Ipv4Associations))
+	for publicIp := range eni.Ipv4Associations {
+		publicIps = append(publicIps, publicIp)
+	}
+	order := map[string]int{}
+	for i, privateIp := range eni.LocalIpv4s {
+		order[privateIp] = i
+	}
+	sort.Slice(publicIps, func(i, j int) bool {
+		a, b := order[eni.Ipv4Associations[publicIps[i]]], order[eni.Ipv4Associations[publicIps[j]]]
+		if a != b {
+			return a < b
+		}
+		return publicIps[i] < publicIps[j]
+	})
+	return publicIps
+}
+
+// primaryIpv6 backs the top level ipv6 key, which only exists when the primary interface has an IPv6 address
+func (app *App) primaryIpv6() string {
+	if eni := app.primaryNetworkInterface(); eni != nil && len(eni.Ipv6s) > 0 {
+		return eni.Ipv6s[0]
+	}
+	return ""
+}
+
+type interfaceHandlerFunc func(http.ResponseWriter, *http.Request, *NetworkInterface)
+
+// interfaceHandler looks up the interface for the {mac} route variable, 404ing unknown ones
+func (app *App) interfaceHandler(fn interfaceHandlerFunc) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		eni := app.networkInterface(pathVar(r, "mac"))
+		if eni == nil {
+			app.notFoundHandler(w, r)
+			return
+		}
+		fn(w, r, eni)
+	}
+}
+
+func (app *App) networkInterfacesMacsHandler(w http.ResponseWriter, r *http.Request) {
+	macs := make([]string, 0, len(app.NetworkInterfaces))
+	for _, eni := range app.NetworkInterfaces {
+		macs = append(macs, eni.Mac+"/")
+	}
+	write(w, strings.Join(macs, "\n"))
+}
+
+// Keys without a value are not listed, like real IMDS
+func (app *App) networkInterfacesMacsAddrHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	keys := []string{"device-number"}
+	optional := func(key string, set bool) {
+		if set {
+			keys = append(keys, key)
+		}
+	}
+	optional("interface-id", eni.InterfaceID != "")
+	optional("ipv4-associations/", len(eni.Ipv4Associations) > 0)
+	optional("ipv6s", len(eni.Ipv6s) > 0)
+	optional("local-hostname", eni.LocalHostname != "")
+	optional("local-ipv4s", len(eni.LocalIpv4s) > 0)
+	keys = append(keys, "mac")
+	optional("owner-id", eni.OwnerID != "")
+	optional("public-hostname", len(eni.Ipv4Associations) > 0)
+	optional("public-ipv4s", len(eni.Ipv4Associations) > 0)
+	optional("security-group-ids", len(eni.SecurityGroupIDs) > 0)
+	optional("security-groups", len(eni.SecurityGroups) > 0)
+	optional("subnet-id", eni.SubnetID != "")
+	optional("subnet-ipv4-cidr-block", eni.SubnetIpv4CidrBlock != "")
+	optional("subnet-ipv6-cidr-blocks", len(eni.SubnetIpv6CidrBlocks) > 0)
+	optional("vpc-id", eni.VpcID != "")
+	optional("vpc-ipv4-cidr-block", len(eni.VpcIpv4CidrBlocks) > 0)
+	optional("vpc-ipv4-cidr-blocks", len(eni.VpcIpv4CidrBlocks) > 0)
+	optional("vpc-ipv6-cidr-blocks", len(eni.VpcIpv6CidrBlocks) > 0)
+	writeListing(w, r, keys)
+}
+
+func (app *App) nimAddrRedirectHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.trailingSlashRedirect(w, r)
+}
+
+func (app *App) nimAddrDeviceNumberHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	write(w, strconv.Itoa(eni.DeviceNumber))
+}
+
+func (app *App) nimAddrInterfaceIdHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceValueHandler(w, r, eni.InterfaceID)
+}
+
+func (app *App) nimAddrIpv4AssociationsHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceListHandler(w, r, eni.publicIpv4s())
+}
+
+func (app *App) nimAddrIpv4AssociationHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	privateIp, ok := eni.Ipv4Associations[pathVar(r, "ip")]
+	if !ok {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, privateIp)
+}
+
+func (app *App) nimAddrIpv6sHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceListHandler(w, r, eni.Ipv6s)
+}
+
+func (app *App) nimAddrLocalHostnameHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceValueHandler(w, r, eni.LocalHostname)
+}
+
+func (app *App) nimAddrLocalIpv4sHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceListHandler(w, r, eni.LocalIpv4s)
+}
+
+func (app *App) nimAddrMacHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	write(w, eni.Mac)
+}
+
+func (app *App) nimAddrOwnerIdHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceValueHandler(w, r, eni.OwnerID)
+}
+
+func (app *App) nimAddrPublicHostnameHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	if len(eni.Ipv4Associations) == 0 {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, app.publicHostname(eni))
+}
+
+func (app *App) nimAddrPublicIpv4sHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceListHandler(w, r, eni.publicIpv4s())
+}
+
+func (app *App) nimAddrSecurityGroupIdsHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceListHandler(w, r, eni.SecurityGroupIDs)
+}
+
+func (app *App) nimAddrSecurityGroupsHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceListHandler(w, r, eni.SecurityGroups)
+}
+
+func (app *App) nimAddrSubnetIdHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceValueHandler(w, r, eni.SubnetID)
+}
+
+func (app *App) nimAddrSubnetIpv4CidrBlockHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceValueHandler(w, r, eni.SubnetIpv4CidrBlock)
+}
+
+func (app *App) nimAddrSubnetIpv6CidrBlocksHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceListHandler(w, r, eni.SubnetIpv6CidrBlocks)
+}
+
+func (app *App) nimAddrVpcIdHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceValueHandler(w, r, eni.VpcID)
+}
+
+func (app *App) nimAddrVpcIpv4CidrBlockHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	if len(eni.VpcIpv4CidrBlocks) == 0 {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, eni.VpcIpv4CidrBlocks[0])
+}
+
+func (app *App) nimAddrVpcIpv4CidrBlocksHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceListHandler(w, r, eni.VpcIpv4CidrBlocks)
+}
+
+func (app *App) nimAddrVpcIpv6CidrBlocksHandler(w http.ResponseWriter, r *http.Request, eni *NetworkInterface) {
+	app.interfaceListHandler(w, r, eni.VpcIpv6CidrBlocks)
+}
+
+// interfaceValueHandler writes the value, 404ing when the interface does not have it
+func (app *App) interfaceValueHandler(w http.ResponseWriter, r *http.Request, value string) {
+	if value == "" {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, value)
+}
+
+// interfaceListHandler writes one value per line, 404ing for optional keys the interface does not have
+func (app *App) interfaceListHandler(w http.ResponseWriter, r *http.Request, values []string) {
+	if len(values) == 0 {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, strings.Join(values, "\n"))
+}
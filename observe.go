@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// requestInfo is what the handlers learn about a request, for observeRequests to record once it is served
+type requestInfo struct {
+	// Route the request matched, e.g. /{version}/meta-data/network/interfaces/macs/{mac}/local-ipv4s
+	template string
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the requestInfo of a request passed through observeRequests, nil otherwise
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// imdsVersion returns v2 for requests with a session token and for the token PUTs themselves, v1 otherwise
+func imdsVersion(r *http.Request) string {
+	if r.Header.Get("X-aws-ec2-metadata-token") != "" || strings.HasSuffix(r.URL.Path, "/api/token") {
+		return "v2"
+	}
+	return "v1"
+}
+
+// statusRecorder remembers the status and size of the response written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// observeRequests records every request in the journal, the metrics and the access log, including the ones whose
+// connection is dropped
+func (app *App) observeRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		e := JournalEntry{
+			Time:        app.clock.now().Format(time.RFC3339Nano),
+			Client:      client,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Headers:     r.Header.Clone(),
+			Token:       r.Header.Get("X-aws-ec2-metadata-token") != "",
+			ImdsVersion: imdsVersion(r),
+		}
+		info := &requestInfo{}
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			duration := time.Since(start)
+			e.Status = sr.status
+			app.mu.RLock()
+			size := app.JournalSize
+			app.mu.RUnlock()
+			if size > 0 {
+				app.journal.record(e, size)
+			}
+			app.metrics.observe(info.template, e.Status, e.ImdsVersion, duration)
+			log.WithFields(log.Fields{
+				"client":       e.Client,
+				"method":       e.Method,
+				"path":         e.Path,
+				"route":        info.template,
+				"status":       e.Status,
+				"bytes":        sr.bytes,
+				"duration":     duration.Seconds(),
+				"imds_version": e.ImdsVersion,
+			}).Info("access")
+		}()
+		h.ServeHTTP(sr, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+	})
+}
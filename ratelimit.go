@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RateLimitCounters are the requests a client made and how many of them were throttled
+type RateLimitCounters struct {
+	Requests  int64 `json:"requests"`
+	Throttled int64 `json:"throttled"`
+}
+
+// How long a client goes without requests once its bucket is full again before it's forgotten, along with its
+// counters, so clients that come and go (e.g. containers) don't pile up
+const rateLimitIdle = time.Minute
+
+// rateLimiter throttles each client (source IP) with a token bucket, like IMDS throttles each ENI
+type rateLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*rateLimitClient
+	// When idle clients were last forgotten
+	swept time.Time
+}
+
+type rateLimitClient struct {
+	RateLimitCounters
+	tokens  float64
+	updated time.Time
+}
+
+// allow reports whether the client may make another request at rate requests per second, with bursts of up to
+// burst requests, and counts it
+func (l *rateLimiter) allow(client string, rate float64, burst int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients == nil {
+		l.clients = map[string]*rateLimitClient{}
+	}
+	if now.Sub(l.swept) >= rateLimitIdle {
+		l.sweep(rate, burst, now)
+	}
+	c, ok := l.clients[client]
+	if !ok {
+		c = &rateLimitClient{tokens: float64(burst), updated: now}
+		l.clients[client] = c
+	}
+	c.Requests++
+	if rate <= 0 {
+		c.updated = now
+		return true
+	}
+
+	c.tokens += now.Sub(c.updated).Seconds() * rate
+	if c.tokens > float64(burst) {
+		c.tokens = float64(burst)
+	}
+	c.updated = now
+	if c.tokens < 1 {
+		c.Throttled++
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+// sweep forgets the clients whose bucket has been full for rateLimitIdle, l.mu must be held
+func (l *rateLimiter) sweep(rate float64, burst int, now time.Time) {
+	for client, c := range l.clients {
+		idle := now.Sub(c.updated)
+		if rate > 0 {
+			idle -= time.Duration((float64(burst) - c.tokens) / rate * float64(time.Second))
+		}
+		if idle >= rateLimitIdle {
+			delete(l.clients, client)
+		}
+	}
+	l.swept = now
+}
+
+// counters returns a copy of the counters of each client
+func (l *rateLimiter) counters() map[string]RateLimitCounters {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counters := make(map[string]RateLimitCounters, len(l.clients))
+	for client, c := range l.clients {
+		counters[client] = c.RateLimitCounters
+	}
+	return counters
+}
+
+// reset forgets every client, refilling their buckets and zeroing their counters
+func (l *rateLimiter) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clients = nil
+}
+
+// rateLimitBurst returns the configured burst, by default a second's worth of requests
+func (app *App) rateLimitBurst() int {
+	if app.RateLimitBurst > 0 {
+		return app.RateLimitBurst
+	}
+	return int(math.Ceil(app.RateLimit))
+}
+
+// RateLimits are the rate limit settings and the counters of each client, as shown by the admin API
+type RateLimits struct {
+	Rate    float64                      `json:"rate"`
+	Burst   int                          `json:"burst"`
+	Drop    bool                         `json:"drop"`
+	Clients map[string]RateLimitCounters `json:"clients"`
+}
+
+func (app *App) rateLimits() RateLimits {
+	return RateLimits{
+		Rate:    app.RateLimit,
+		Burst:   app.rateLimitBurst(),
+		Drop:    app.RateLimitDrop,
+		Clients: app.limiter.counters(),
+	}
+}
+
+// rateLimit throttles clients making more than RateLimit requests per second, with a 429 or by dropping the
+// connection when RateLimitDrop is set. Every request is counted, even when there is no limit.
+func (app *App) rateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if app.limiter.allow(client, app.RateLimit, app.rateLimitBurst(), time.Now()) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if app.RateLimitDrop {
+			log.Infof("Dropping %s %s from %s, rate limit exceeded", r.Method, r.RequestURI, client)
+			panic(http.ErrAbortHandler)
+		}
+		log.Infof("Throttling %s %s from %s, rate limit exceeded", r.Method, r.RequestURI, client)
+		writeError(w, 429)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	now := time.Date(2020, 4, 7, 3, 56, 56, 0, time.UTC)
+
+	// A burst of 2, then 1 request per second
+	for i, expected := range []bool{true, true, false} {
+		if got := l.allow("10.0.0.1", 1, 2, now); got != expected {
+			t.Errorf("request %d : Expected allowed %v, got %v", i, expected, got)
+		}
+	}
+	if !l.allow("10.0.0.2", 1, 2, now) {
+		t.Errorf("Expected other clients not to be throttled")
+	}
+	if l.allow("10.0.0.1", 1, 2, now.Add(500*time.Millisecond)) {
+		t.Errorf("Expected a request after half a second to be throttled")
+	}
+	if !l.allow("10.0.0.1", 1, 2, now.Add(1500*time.Millisecond)) {
+		t.Errorf("Expected a request after a second and a half to be allowed")
+	}
+
+	counters := l.counters()
+	if counters["10.0.0.1"] != (RateLimitCounters{Requests: 5, Throttled: 2}) {
+		t.Errorf("Expected 5 requests, 2 of them throttled, got %+v", counters["10.0.0.1"])
+	}
+	l.reset()
+	if len(l.counters()) != 0 {
+		t.Errorf("Expected no counters after a reset, got %+v", l.counters())
+	}
+}
+
+func TestRateLimiterForgetsIdleClients(t *testing.T) {
+	var l rateLimiter
+	now := time.Date(2020, 4, 7, 3, 56, 56, 0, time.UTC)
+
+	// Emptying a bucket of 10 at 1 request per second, it takes 10s to be full again
+	for i := 0; i < 10; i++ {
+		l.allow("10.0.0.1", 1, 10, now)
+	}
+	l.allow("10.0.0.2", 1, 10, now)
+	l.allow("10.0.0.3", 1, 10, now.Add(rateLimitIdle+time.Second))
+	if _, ok := l.counters()["10.0.0.1"]; !ok {
+		t.Errorf("Expected a client to be kept until its bucket is full again")
+	}
+	if _, ok := l.counters()["10.0.0.2"]; ok {
+		t.Errorf("Expected an idle client to be forgotten")
+	}
+
+	l.allow("10.0.0.3", 1, 10, now.Add(rateLimitIdle+11*time.Second))
+	if counters := l.counters(); len(counters) != 2 {
+		t.Errorf("Expected clients to be forgotten at most once per %s, got %+v", rateLimitIdle, counters)
+	}
+	l.allow("10.0.0.3", 1, 10, now.Add(2*rateLimitIdle+11*time.Second))
+	if counters := l.counters(); len(counters) != 1 || counters["10.0.0.3"].Requests != 3 {
+		t.Errorf("Expected only the active client to be kept, got %+v", counters)
+	}
+}
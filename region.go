@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matches the region at the start of an availability zone name, covering the standard
+// (us-east-1a), Local Zone (us-west-2-lax-1a), Wavelength (us-east-1-wl1-bos-wlz-1) and
+// partition specific (us-gov-west-1a, us-iso-east-1a, cn-north-1a) naming schemes.
+var availabilityZoneRegionRegexp = regexp.MustCompile(`^([a-z]{2}(?:-[a-z]+)+-\d+)(.*)$`)
+
+// Short forms of the region name parts used in availability zone IDs, e.g. use1-az1
+var availabilityZoneIDAbbreviations = map[string]string{
+	"central":   "c",
+	"east":      "e",
+	"gov":       "g",
+	"iso":       "i",
+	"isob":      "ib",
+	"north":     "n",
+	"northeast": "ne",
+	"northwest": "nw",
+	"south":     "s",
+	"southeast": "se",
+	"southwest": "sw",
+	"west":      "w",
+}
+
+// Partitions by region name prefix, checked in order so the more specific prefixes win
+var partitions = []struct {
+	prefix string
+	name   string
+	domain string
+}{
+	{"cn-", "aws-cn", "amazonaws.com.cn"},
+	{"us-gov-", "aws-us-gov", "amazonaws.com"},
+	{"us-isob-", "aws-iso-b", "sc2s.sgov.gov"},
+	{"us-isof-", "aws-iso-f", "csp.hci.ic.gov"},
+	{"eu-isoe-", "aws-iso-e", "cloud.adc-e.uk"},
+	{"us-iso-", "aws-iso", "c2s.ic.gov"},
+	{"", "aws", "amazonaws.com"},
+}
+
+// partitionForRegion returns the partition name and service domain a region belongs to
+func partitionForRegion(region string) (string, string) {
+	for _, p := range partitions {
+		if strings.HasPrefix(region, p.prefix) {
+			return p.name, p.domain
+		}
+	}
+	return "aws", "amazonaws.com"
+}
+
+// regionFromAvailabilityZone returns the region an availability zone belongs to, or an
+// empty string if the zone name is not recognised.
+func regionFromAvailabilityZone(az string) string {
+	m := availabilityZoneRegionRegexp.FindStringSubmatch(az)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// availabilityZoneIDFromName derives a plausible availability zone ID from its name. On AWS the
+// mapping is account specific, this just keeps the zone and ID consistent with each other.
+func availabilityZoneIDFromName(az string) string {
+	m := availabilityZoneRegionRegexp.FindStringSubmatch(az)
+	if m == nil {
+		return ""
+	}
+	parts := strings.Split(m[1], "-")
+	abbreviation := parts[0]
+	for _, part := range parts[1:] {
+		if short, ok := availabilityZoneIDAbbreviations[part]; ok {
+			abbreviation += short
+		} else {
+			abbreviation += part
+		}
+	}
+
+	// Standard zones end with a letter, Local Zones and Wavelength Zones carry their own suffix
+	suffix := strings.TrimPrefix(m[2], "-")
+	zone := 0
+	if n := len(suffix); n > 0 && suffix[n-1] >= 'a' && suffix[n-1] <= 'z' {
+		zone = int(suffix[n-1]-'a') + 1
+		suffix = suffix[:n-1]
+	}
+	if i := strings.LastIndex(suffix, "-"); i >= 0 {
+		suffix = suffix[:i] + suffix[i+1:]
+	}
+	if suffix != "" {
+		abbreviation += "-" + suffix
+	}
+	if zone > 0 {
+		abbreviation += fmt.Sprintf("-az%d", zone)
+	}
+	return abbreviation
+}
+
+// region returns the configured region, falling back to the one derived from the availability zone
+func (app *App) region() string {
+	if app.Region != "" {
+		return app.Region
+	}
+	return regionFromAvailabilityZone(app.AvailabilityZone)
+}
+
+// availabilityZoneID returns the configured availability zone ID, falling back to a derived one
+func (app *App) availabilityZoneID() string {
+	if app.AvailabilityZoneID != "" {
+		return app.AvailabilityZoneID
+	}
+	return availabilityZoneIDFromName(app.AvailabilityZone)
+}
+
+// partition returns the partition of the instance's region, e.g. aws-cn
+func (app *App) partition() string {
+	partition, _ := partitionForRegion(app.region())
+	return partition
+}
+
+// serviceDomain returns the domain of the AWS service endpoints in the instance's region
+func (app *App) serviceDomain() string {
+	_, domain := partitionForRegion(app.region())
+	return domain
+}
+
+// arn builds an ARN in the instance's partition and account
+func (app *App) arn(service string, resource string) string {
+	return fmt.Sprintf("arn:%s:%s::%s:%s", app.partition(), service, app.AccountID, resource)
+}
@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestRegionFromAvailabilityZone(t *testing.T) {
+	tests := map[string]string{
+		"us-east-1a":              "us-east-1",
+		"ap-southeast-2c":         "ap-southeast-2",
+		"us-west-2-lax-1a":        "us-west-2",
+		"us-east-1-wl1-bos-wlz-1": "us-east-1",
+		"us-gov-west-1a":          "us-gov-west-1",
+		"us-iso-east-1a":          "us-iso-east-1",
+		"cn-north-1b":             "cn-north-1",
+		"":                        "",
+		"bogus":                   "",
+	}
+	for az, expected := range tests {
+		if region := regionFromAvailabilityZone(az); region != expected {
+			t.Errorf("%q : Expected region %q, got %q", az, expected, region)
+		}
+	}
+}
+
+func TestAvailabilityZoneIDFromName(t *testing.T) {
+	tests := map[string]string{
+		"us-east-1a":              "use1-az1",
+		"ap-southeast-2c":         "apse2-az3",
+		"us-west-2-lax-1a":        "usw2-lax1-az1",
+		"us-east-1-wl1-bos-wlz-1": "use1-wl1-bos-wlz1",
+		"us-gov-west-1a":          "usgw1-az1",
+		"":                        "",
+	}
+	for az, expected := range tests {
+		if id := availabilityZoneIDFromName(az); id != expected {
+			t.Errorf("%q : Expected availability zone ID %q, got %q", az, expected, id)
+		}
+	}
+}
+
+func TestPartitionForRegion(t *testing.T) {
+	tests := map[string][2]string{
+		"us-east-1":      {"aws", "amazonaws.com"},
+		"cn-northwest-1": {"aws-cn", "amazonaws.com.cn"},
+		"us-gov-west-1":  {"aws-us-gov", "amazonaws.com"},
+		"us-iso-east-1":  {"aws-iso", "c2s.ic.gov"},
+		"us-isob-east-1": {"aws-iso-b", "sc2s.sgov.gov"},
+		"":               {"aws", "amazonaws.com"},
+	}
+	for region, expected := range tests {
+		if partition, domain := partitionForRegion(region); partition != expected[0] || domain != expected[1] {
+			t.Errorf("%q : Expected partition %s and domain %s, got %s and %s", region, expected[0], expected[1], partition, domain)
+		}
+	}
+}
+
+func TestArnPartition(t *testing.T) {
+	app := NewApp()
+	app.AccountID = "123456789012"
+	app.Region = "cn-north-1"
+	expected := "arn:aws-cn:iam::123456789012:instance-profile/some-instance-profile"
+	if arn := app.arn("iam", "instance-profile/some-instance-profile"); arn != expected {
+		t.Errorf("Expected %s, got %s", expected, arn)
+	}
+}
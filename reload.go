@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// reload loads the config file and command line again, and once the result is validated swaps it in at once.
+// The routes are rebuilt. Issued tokens, the clock, journal, metrics and rate limit counters are kept, as are the
+// listeners and the scenario, which are only set up at startup. Changes made through the admin API are replaced.
+func (app *App) reload() error {
+	// Only reload writes the parameters compared below, so they are read without holding app.mu
+	app.reloading.Lock()
+	defer app.reloading.Unlock()
+	next, err := loadApp(app.args)
+	if err != nil {
+		return err
+	}
+	if next.AppInterface != app.AppInterface || next.AppPort != app.AppPort || next.AppInterfaceIpv6 != app.AppInterfaceIpv6 ||
+		next.AdminInterface != app.AdminInterface || next.AdminPort != app.AdminPort ||
+		next.ReadTimeout != app.ReadTimeout || next.WriteTimeout != app.WriteTimeout || next.IdleTimeout != app.IdleTimeout {
+		log.Warnf("Listeners and their timeouts only change on restart")
+	}
+	if next.ScenarioFile != app.ScenarioFile || next.ClockStart != app.ClockStart || next.FreezeClock != app.FreezeClock {
+		log.Warnf("The scenario and clock only change on restart")
+	}
+	next.AppInterface, next.AppPort, next.AppInterfaceIpv6 = app.AppInterface, app.AppPort, app.AppInterfaceIpv6
+	next.AdminInterface, next.AdminPort = app.AdminInterface, app.AdminPort
+	next.ReadTimeout, next.WriteTimeout, next.IdleTimeout = app.ReadTimeout, app.WriteTimeout, app.IdleTimeout
+	next.ScenarioFile, next.ClockStart, next.FreezeClock = app.ScenarioFile, app.ClockStart, app.FreezeClock
+	// Kept unless key files are configured, rather than generating a key on every reload
+	next.identitySigner = app.identitySigner
+	// The scenario running is checked against the new network interfaces, rather than the file read again
+	next.scenario = app.scenario
+
+	if err := next.prepare(); err != nil {
+		return err
+	}
+	if err := app.configureLogging(next); err != nil {
+		return err
+	}
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	// Every exported field is a parameter
+	dst, src := reflect.ValueOf(app).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if dst.Type().Field(i).PkgPath == "" {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	app.containerNets = next.containerNets
+	// Which routes exist depends on the parameters, e.g. the role name
+	app.router = app.newRouter()
+	app.identitySigner = next.identitySigner
+	// Unless configured, the launch time stays the one at startup
+	if next.LaunchTime != "" {
+		app.launchTime = next.launchTime
+	}
+	app.faults.remove(0)
+	// Validated by prepare
+	app.faults.add(app.Faults...)
+	return nil
+}
+
+// reloadOn reloads the configuration, keeping the current one if the new one is invalid
+func (app *App) reloadOn(reason string) {
+	if err := app.reload(); err != nil {
+		log.Errorf("Error reloading configuration on %s, keeping the current one: %+v", reason, err)
+		return
+	}
+	log.Infof("Reloaded configuration on %s", reason)
+}
+
+// watchConfigFile reloads the configuration whenever the file's modification time or size changes
+func (app *App) watchConfigFile(file string) {
+	last, _ := os.Stat(file)
+	for range time.Tick(configPollInterval) {
+		info, err := os.Stat(file)
+		if err != nil {
+			// Possibly being replaced, checked again next time
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		app.reloadOn("change to " + file)
+	}
+}
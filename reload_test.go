@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{"config.yaml": `
+instance-id: i-before
+mock-instance-profile: true
+app-port: "8080"
+faults:
+- path: /latest/meta-data/instance-id
+  status: 500
+`})
+	defer cleanup()
+	app, err := loadApp([]string{"--config", paths["config.yaml"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	launchTime, signer := app.launchTime, app.identitySigner
+	now := app.clock.now()
+	token := app.tokens.issue(60, now)
+
+	if err := ioutil.WriteFile(paths["config.yaml"], []byte(`
+instance-id: i-after
+mock-instance-profile: true
+app-port: "9090"
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if app.InstanceID != "i-after" {
+		t.Errorf("Expected the instance ID to be reloaded, got %s", app.InstanceID)
+	}
+	if app.AppPort != "8080" {
+		t.Errorf("Expected the port to only change on restart, got %s", app.AppPort)
+	}
+	if faults := app.faults.list(); len(faults) != 0 {
+		t.Errorf("Expected the faults to be reloaded, got %+v", faults)
+	}
+	if app.launchTime != launchTime || app.identitySigner != signer {
+		t.Errorf("Expected the launch time and identity key to be kept")
+	}
+	// Rather than generated again and thrown away
+	next := NewApp()
+	next.identitySigner = signer
+	if err := next.loadIdentitySigner(); err != nil || next.identitySigner != signer {
+		t.Errorf("Expected the identity key to be kept without key files, got %+v", err)
+	}
+	if _, ok := app.tokens.ttl(token, now); !ok {
+		t.Errorf("Expected issued tokens to stay valid")
+	}
+
+	if err := ioutil.WriteFile(paths["config.yaml"], []byte(`
+instance-id: i-invalid
+http-endpoint: sometimes
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.reload(); err == nil {
+		t.Errorf("Expected an invalid config to be rejected")
+	}
+	if app.InstanceID != "i-after" {
+		t.Errorf("Expected the current config to be kept, got %s", app.InstanceID)
+	}
+}
+
+func TestReloadRoutes(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{"config.yaml": "mock-instance-profile: true\nrole-name: before\n"})
+	defer cleanup()
+	app, err := loadApp([]string{"--config", paths["config.yaml"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	h := app.NewServer()
+	status := func(uri string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", uri, nil))
+		return w.Code
+	}
+	if code := status("/latest/meta-data/iam/security-credentials/before"); code != 200 {
+		t.Errorf("Expected the role's credentials, got %d", code)
+	}
+
+	if err := ioutil.WriteFile(paths["config.yaml"], []byte("mock-instance-profile: true\nrole-name: after\nplacement-group-name: web\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code := status("/latest/meta-data/iam/security-credentials/after"); code != 200 {
+		t.Errorf("Expected the renamed role's credentials, got %d", code)
+	}
+	if code := status("/latest/meta-data/iam/security-credentials/before"); code != 404 {
+		t.Errorf("Expected the old role to be gone, got %d", code)
+	}
+	if code := status("/latest/meta-data/placement/group-name"); code != 200 {
+		t.Errorf("Expected the new placement group, got %d", code)
+	}
+}
+
+// Run with -race to check reloads are safe while requests are served
+func TestReloadDuringRequests(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{"config.yaml": "mock-instance-profile: true\njournal-size: 5\n"})
+	defer cleanup()
+	app, err := loadApp([]string{"--config", paths["config.yaml"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	h, admin := app.NewServer(), app.NewAdminServer()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/latest/meta-data/instance-id", nil))
+			admin.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/journal", nil))
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if err := app.reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestReloadScenarioInterfaces(t *testing.T) {
+	config := `
+scenario-file: %s
+network-interfaces:
+  - mac: 0e:00:00:00:00:01
+    local-ipv4s: [172.16.0.10]
+`
+	paths, cleanup := writeTempFiles(t, map[string]string{
+		"scenario.yaml": "steps:\n  - at: 1h\n    private-ip:\n      mac: 0e:00:00:00:00:02\n      ip: 172.16.1.99\n",
+		"config.yaml":   "",
+	})
+	defer cleanup()
+	write := func(interfaces string) {
+		if err := ioutil.WriteFile(paths["config.yaml"], []byte(fmt.Sprintf(config, paths["scenario.yaml"])+interfaces), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("  - mac: 0e:00:00:00:00:02\n    device-number: 1\n    local-ipv4s: [172.16.1.20]\n")
+	app, err := loadApp([]string{"--config", paths["config.yaml"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	step := app.scenario.Steps[0]
+
+	// The step is dropped from the file, but is still the one to run
+	if err := ioutil.WriteFile(paths["scenario.yaml"], []byte("steps:\n  - at: 1h\n    rotate-credentials: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	write("")
+	if err := app.reload(); err == nil {
+		t.Errorf("Expected removing an interface the running scenario changes to be rejected")
+	}
+	if app.networkInterface("0e:00:00:00:00:02") == nil {
+		t.Errorf("Expected the current interfaces to be kept")
+	}
+
+	// Skipped rather than crashing, should the interface be gone anyway
+	app.NetworkInterfaces = app.NetworkInterfaces[:1]
+	app.runScenarioStep(step, app.clock.now())
+	if !step.Done {
+		t.Errorf("Expected the step to be done")
+	}
+}
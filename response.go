@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// imdsResponseWriter buffers a response, so the headers real IMDS sends that depend on the body (Content-Length,
+// ETag) can be added once the handler is done
+type imdsResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *imdsResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *imdsResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.body.Write(b)
+}
+
+// imdsResponses sends the headers real IMDS does. Every response comes from EC2ws and closes the connection,
+// and successful ones are text/plain, whatever the body, with an ETag and the launch time as Last-Modified.
+func (app *App) imdsResponses(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &imdsResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+
+		header := w.Header()
+		if rw.status == http.StatusOK {
+			app.mu.RLock()
+			launchTime := app.launchTime
+			app.mu.RUnlock()
+			header.Set("Accept-Ranges", "none")
+			header.Set("Last-Modified", launchTime.Format(http.TimeFormat))
+			header.Set("ETag", etag(rw.body.Bytes()))
+		}
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", "text/plain")
+		}
+		header.Set("Content-Length", strconv.Itoa(rw.body.Len()))
+		header.Set("Server", "EC2ws")
+		header.Set("Connection", "close")
+		w.WriteHeader(rw.status)
+		if r.Method != "HEAD" {
+			if _, err := w.Write(rw.body.Bytes()); err != nil {
+				log.Errorf("Error writing response: %+v", err)
+			}
+		}
+	})
+}
+
+// etag returns a strong entity tag for a response body
+func etag(body []byte) string {
+	h := fnv.New64a()
+	h.Write(body)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// writeError writes the HTML error page real IMDS sends for 400, 401, 403 and 404 responses
+func writeError(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	write(w, fmt.Sprintf(`<?xml version="1.0" encoding="iso-8859-1"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
+"http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+<head>
+<title>%[1]d - %[2]s</title>
+</head>
+<body>
+<h1>%[1]d - %[2]s</h1>
+</body>
+</html>`, status, http.StatusText(status)))
+}
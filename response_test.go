@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+// Requests a token from the test server, valid for ttl seconds
+func doTokenRequest(t *testing.T, ttl string) string {
+	req, err := http.NewRequest("PUT", testServer.URL+"/latest/api/token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", ttl)
+	res, err := testHttpClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("PUT /latest/api/token : Expected HTTP Status Code 200, got %d\n", res.StatusCode)
+	}
+	if res.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds") != ttl {
+		t.Errorf("PUT /latest/api/token : Expected 'X-Aws-Ec2-Metadata-Token-Ttl-Seconds' HTTP response header of %s, got %s\n",
+			ttl, res.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds"))
+	}
+	return string(body)
+}
+
+// Sends a GET with an IMDSv2 session token, returning the status and remaining TTL of the token
+func doTokenGet(t *testing.T, uri string, token string) (int, string) {
+	req, err := http.NewRequest("GET", testServer.URL+uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	res, err := testHttpClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode, res.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds")
+}
+
+// Compares the full response, less the Date header, to testdata/golden/<name>.txt
+func doGoldenTest(t *testing.T, name string, method string, uri string, headers map[string]string) {
+	req, err := http.NewRequest(method, testServer.URL+uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := testHttpClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transport consumes the Connection header
+	if res.Close {
+		res.Header.Set("Connection", "close")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", res.Proto, res.Status)
+	keys := make([]string, 0, len(res.Header))
+	for k := range res.Header {
+		if k != "Date" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s: %s\n", k, strings.Join(res.Header[k], ", "))
+	}
+	fmt.Fprintf(&b, "\n%s", body)
+
+	file := filepath.Join("testdata", "golden", name+".txt")
+	if *updateGolden {
+		if err := ioutil.WriteFile(file, []byte(b.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != string(expected) {
+		t.Errorf("%s %s : Expected\n\n%s\n\ngot\n\n%s", method, uri, expected, b.String())
+	}
+}
+
+func TestGoldenResponses(t *testing.T) {
+	doGoldenTest(t, "instance-id", "GET", "/latest/meta-data/instance-id", nil)
+	doGoldenTest(t, "instance-id-head", "HEAD", "/latest/meta-data/instance-id", nil)
+	doGoldenTest(t, "meta-data-redirect", "GET", "/latest/meta-data", nil)
+	doGoldenTest(t, "security-credentials", "GET", "/latest/meta-data/iam/security-credentials/", nil)
+	doGoldenTest(t, "not-found", "GET", "/latest/meta-data/does-not-exist", nil)
+	doGoldenTest(t, "token-missing-ttl", "PUT", "/latest/api/token", nil)
+	doGoldenTest(t, "token-forwarded", "PUT", "/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "21600", "X-Forwarded-For": "10.20.30.40"})
+	doGoldenTest(t, "token-not-put", "GET", "/latest/api/token", nil)
+	doGoldenTest(t, "token-invalid", "GET", "/latest/meta-data/instance-id",
+		map[string]string{"X-aws-ec2-metadata-token": "invalid"})
+}
+
+func TestTokenStore(t *testing.T) {
+	var s tokenStore
+	now := time.Now()
+	token := s.issue(60, now)
+	if ttl, ok := s.ttl(token, now); !ok || ttl != 60 {
+		t.Errorf("Expected a token valid for 60 seconds, got %d %v", ttl, ok)
+	}
+	if ttl, ok := s.ttl(token, now.Add(59500*time.Millisecond)); !ok || ttl != 1 {
+		t.Errorf("Expected a token valid for 1 more second, got %d %v", ttl, ok)
+	}
+	if _, ok := s.ttl(token, now.Add(time.Minute)); ok {
+		t.Errorf("Expected an expired token to be invalid")
+	}
+	if _, ok := s.ttl("invalid", now); ok {
+		t.Errorf("Expected an unknown token to be invalid")
+	}
+}
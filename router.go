@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// route is a node of the path trie the metadata server dispatches requests with. The trie holds
+// the paths below the version prefix once, and is shared by every API version.
+type route struct {
+	// API version the key was introduced in, see keyVersions
+	since    string
+	children map[string]*route
+	// Matches any other path segment, capturing it as paramName
+	param     *route
+	paramName string
+	// Serve the path without and with a trailing slash
+	handler    http.Handler
+	dirHandler http.Handler
+	// Method specific handlers, taking precedence over handler
+	methods map[string]http.Handler
+	// The path with its parameters, e.g. /{version}/meta-data/public-keys/{index}, see requestInfo
+	template string
+}
+
+// router serves / and /{version}/... from a single route trie
+type router struct {
+	root        *route
+	versions    map[string]bool
+	rootHandler http.Handler
+	notFound    http.Handler
+	redirect    http.Handler
+	// Serve the directory listing for paths without a trailing slash, rather than redirecting
+	noRedirects func() bool
+}
+
+type routeVarsKey struct{}
+
+// routeVars holds the name, value pairs of the path parameters captured while matching a request
+type routeVars []string
+
+func newRouter(versions []string, rootHandler http.Handler, notFound http.Handler, redirect http.Handler) *router {
+	rt := &router{
+		root:        &route{since: "1.0", template: "/{version}"},
+		versions:    make(map[string]bool, len(versions)),
+		rootHandler: rootHandler,
+		notFound:    notFound,
+		redirect:    redirect,
+	}
+	for _, v := range versions {
+		rt.versions[v] = true
+	}
+	return rt
+}
+
+// node returns the trie node for path (below the version prefix), creating it and its parents
+// as needed. Segments in braces, e.g. {mac}, match any value.
+func (rt *router) node(path string) *route {
+	n := rt.root
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return n
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if n.param == nil {
+				n.param = &route{}
+				n.paramName = segment[1 : len(segment)-1]
+			}
+			n = n.param
+		} else {
+			if n.children == nil {
+				n.children = map[string]*route{}
+			}
+			child, ok := n.children[segment]
+			if !ok {
+				child = &route{}
+				n.children[segment] = child
+			}
+			n = child
+		}
+	}
+	n.since = keyVersion(path)
+	n.template = "/{version}/" + path
+	return n
+}
+
+// handle registers h for path, which serves the directory listing if it ends with a slash
+func (rt *router) handle(path string, h http.Handler) {
+	n := rt.node(path)
+	if strings.HasSuffix(path, "/") {
+		n.dirHandler = h
+	} else {
+		n.handler = h
+	}
+}
+
+// key registers h for path with and without a trailing slash
+func (rt *router) key(path string, h http.Handler) {
+	n := rt.node(path)
+	n.handler = h
+	n.dirHandler = h
+}
+
+// dir registers the listing h for path/, redirecting path to it
+func (rt *router) dir(path string, h http.Handler) {
+	n := rt.node(path)
+	n.handler = rt.redirect
+	n.dirHandler = h
+}
+
+// methods registers h for path, only for the given request methods
+func (rt *router) methods(path string, h http.Handler, methods ...string) {
+	n := rt.node(path)
+	if n.methods == nil {
+		n.methods = map[string]http.Handler{}
+	}
+	for _, method := range methods {
+		n.methods[method] = h
+	}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	info := requestInfoFrom(r)
+	if path == "" || path == "/" {
+		if info != nil {
+			info.template = "/"
+		}
+		rt.rootHandler.ServeHTTP(w, r)
+		return
+	}
+
+	path = path[1:]
+	version := path
+	rest := ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		version, rest = path[:i], path[i:]
+	}
+	if !rt.versions[version] {
+		rt.notFound.ServeHTTP(w, r)
+		return
+	}
+
+	n := rt.root
+	var vars routeVars
+	// rest is empty or starts with a slash, each iteration consumes one /segment
+	for len(rest) > 1 {
+		rest = rest[1:]
+		segment := rest
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			segment, rest = rest[:i], rest[i:]
+		} else {
+			rest = ""
+		}
+		if child, ok := n.children[segment]; ok {
+			n = child
+		} else if n.param != nil && segment != "" {
+			vars = append(vars, n.paramName, segment)
+			n = n.param
+		} else {
+			rt.notFound.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	h := n.handler
+	if rest == "/" || (n.dirHandler != nil && rt.noRedirects != nil && rt.noRedirects()) {
+		h = n.dirHandler
+	} else if mh, ok := n.methods[r.Method]; ok {
+		h = mh
+	}
+	if h == nil || !versionIncludes(version, n.since) {
+		rt.notFound.ServeHTTP(w, r)
+		return
+	}
+	if info != nil {
+		info.template = n.template
+		if rest == "/" {
+			info.template += "/"
+		}
+	}
+	if vars != nil {
+		r = r.WithContext(context.WithValue(r.Context(), routeVarsKey{}, vars))
+	}
+	h.ServeHTTP(w, r)
+}
+
+// pathVar returns the path parameter name captured by the router, e.g. mac
+func pathVar(r *http.Request, name string) string {
+	vars, _ := r.Context().Value(routeVarsKey{}).(routeVars)
+	for i := 0; i+1 < len(vars); i += 2 {
+		if vars[i] == name {
+			return vars[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+func testRouterHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write(w, name+" "+pathVar(r, "mac")+" "+pathVar(r, "ip"))
+	})
+}
+
+func TestRouter(t *testing.T) {
+	rt := newRouter([]string{"2008-02-01", "latest"}, testRouterHandler("root"), testRouterHandler("not-found"),
+		testRouterHandler("redirect"))
+	rt.key("", testRouterHandler("versions"))
+	rt.dir("meta-data", testRouterHandler("meta-data"))
+	rt.key("meta-data/ami-id", testRouterHandler("ami-id"))
+	rt.key("meta-data/iam/info", testRouterHandler("info"))
+	rt.dir("meta-data/network/interfaces/macs/{mac}/ipv4-associations", testRouterHandler("ipv4-associations"))
+	rt.key("meta-data/network/interfaces/macs/{mac}/ipv4-associations/{ip}", testRouterHandler("ipv4-association"))
+	rt.methods("api/token", testRouterHandler("token"), "PUT")
+
+	tests := []struct {
+		method   string
+		uri      string
+		expected string
+	}{
+		{"GET", "/", "root  "},
+		{"GET", "/latest", "versions  "},
+		{"GET", "/latest/", "versions  "},
+		{"GET", "/2008-02-01/meta-data", "redirect  "},
+		{"GET", "/2008-02-01/meta-data/", "meta-data  "},
+		{"GET", "/latest/meta-data/ami-id", "ami-id  "},
+		{"GET", "/latest/meta-data/ami-id/", "ami-id  "},
+		{"GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/ipv4-associations/",
+			"ipv4-associations 0e:11:22:33:44:55 "},
+		{"GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/ipv4-associations/54.10.20.30",
+			"ipv4-association 0e:11:22:33:44:55 54.10.20.30"},
+		{"PUT", "/latest/api/token", "token  "},
+		// Keys newer than the requested version, unknown versions and paths
+		{"GET", "/2008-02-01/meta-data/iam/info", "not-found  "},
+		{"GET", "/2009-01-01/meta-data/ami-id", "not-found  "},
+		{"GET", "/latest/meta-data/ami-id/foo", "not-found  "},
+		{"GET", "/latest/meta-data//ami-id", "not-found  "},
+		{"GET", "/latest/meta-data/network/interfaces/macs//ipv4-associations/", "not-found  "},
+		{"GET", "/latest/api/token", "not-found  "},
+		{"PUT", "/latest/api/token/", "not-found  "},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(test.method, test.uri, nil))
+		if w.Body.String() != test.expected {
+			t.Errorf("%s %s : Expected %q, got %q", test.method, test.uri, test.expected, w.Body.String())
+		}
+	}
+}
+
+func benchmarkServer(b *testing.B, method string, uri string, headers ...string) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	handler := testApp.NewServer()
+	req := httptest.NewRequest(method, uri, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code >= http.StatusBadRequest && w.Code != http.StatusNotFound {
+			b.Fatalf("%s %s : unexpected HTTP Status Code %d", method, uri, w.Code)
+		}
+	}
+}
+
+func BenchmarkServerInstanceID(b *testing.B) {
+	benchmarkServer(b, "GET", "/latest/meta-data/instance-id")
+}
+
+func BenchmarkServerOldVersionInstanceID(b *testing.B) {
+	benchmarkServer(b, "GET", "/2007-01-19/meta-data/instance-id")
+}
+
+func BenchmarkServerMetaData(b *testing.B) {
+	benchmarkServer(b, "GET", "/latest/meta-data/")
+}
+
+func BenchmarkServerInterfaceSubnetID(b *testing.B) {
+	benchmarkServer(b, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/subnet-id")
+}
+
+func BenchmarkServerSecurityCredentials(b *testing.B) {
+	benchmarkServer(b, "GET", "/latest/meta-data/iam/security-credentials/some-instance-profile")
+}
+
+func BenchmarkServerToken(b *testing.B) {
+	benchmarkServer(b, "PUT", "/latest/api/token", "X-aws-ec2-metadata-token-ttl-seconds", "21600")
+}
+
+func BenchmarkServerNotFound(b *testing.B) {
+	benchmarkServer(b, "GET", "/latest/meta-data/does-not-exist")
+}
+
+// baselineMux rebuilds the dispatch the trie replaced from the same routes, gorilla/mux subrouters for each API
+// version with nested subrouters for each path segment, to compare the trie against
+func baselineMux(app *App, rt *router) http.Handler {
+	r := mux.NewRouter()
+	r.Handle("", rt.rootHandler)
+	r.Handle("/", rt.rootHandler)
+	for _, v := range app.apiVersionPrefixes() {
+		baselineSubrouter(r.PathPrefix("/"+v).Subrouter(), rt.root, v, nil)
+	}
+	r.Handle("/{path:.*}", rt.notFound)
+	return r
+}
+
+func baselineSubrouter(sr *mux.Router, n *route, version string, params []string) {
+	// The handlers read the path parameters the trie captures
+	handler := func(h http.Handler) http.Handler {
+		if len(params) == 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			var rv routeVars
+			for _, name := range params {
+				rv = append(rv, name, vars[name])
+			}
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeVarsKey{}, rv)))
+		})
+	}
+	for method, h := range n.methods {
+		sr.Handle("", handler(h)).Methods(method)
+	}
+	if n.handler != nil {
+		sr.Handle("", handler(n.handler))
+	}
+	if n.dirHandler != nil {
+		sr.Handle("/", handler(n.dirHandler))
+	}
+	var segments []string
+	for segment, child := range n.children {
+		if versionIncludes(version, child.since) {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Strings(segments)
+	for _, segment := range segments {
+		baselineSubrouter(sr.PathPrefix("/"+segment).Subrouter(), n.children[segment], version, params)
+	}
+	if n.param != nil {
+		baselineSubrouter(sr.PathPrefix("/{"+n.paramName+"}").Subrouter(), n.param, version, append(params, n.paramName))
+	}
+}
+
+// Compares the trie to the gorilla/mux subrouters it replaced, e.g. go test -run NONE -bench Dispatch
+func BenchmarkDispatch(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	rt := testApp.newRouter()
+	uris := []string{
+		"/latest/meta-data/instance-id",
+		"/2007-01-19/meta-data/instance-id",
+		"/latest/meta-data/",
+		"/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/subnet-id",
+		"/latest/meta-data/iam/security-credentials/some-instance-profile",
+		"/latest/meta-data/does-not-exist",
+	}
+	baseline := baselineMux(testApp, rt)
+	for _, uri := range uris {
+		trie, mux := httptest.NewRecorder(), httptest.NewRecorder()
+		rt.ServeHTTP(trie, httptest.NewRequest("GET", uri, nil))
+		baseline.ServeHTTP(mux, httptest.NewRequest("GET", uri, nil))
+		if trie.Code != mux.Code || trie.Body.String() != mux.Body.String() {
+			b.Fatalf("GET %s : trie served %d %q, mux %d %q", uri, trie.Code, trie.Body, mux.Code, mux.Body)
+		}
+	}
+	for _, d := range []struct {
+		name    string
+		handler http.Handler
+	}{{"trie", rt}, {"mux", baseline}} {
+		for _, uri := range uris {
+			req := httptest.NewRequest("GET", uri, nil)
+			b.Run(d.name+uri, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					w := httptest.NewRecorder()
+					d.handler.ServeHTTP(w, req)
+					if w.Code >= http.StatusBadRequest && w.Code != http.StatusNotFound {
+						b.Fatalf("GET %s : unexpected HTTP Status Code %d", uri, w.Code)
+					}
+				}
+			})
+		}
+	}
+}
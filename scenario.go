@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Scenario is a timeline of changes made to the instance while the server runs, loaded from ScenarioFile
+type Scenario struct {
+	Steps []*ScenarioStep `yaml:"steps" json:"steps"`
+}
+
+// ScenarioStep makes its changes At a duration after the server starts, e.g. 30s
+type ScenarioStep struct {
+	At                string            `yaml:"at" json:"at"`
+	RotateCredentials bool              `yaml:"rotate-credentials" json:"rotate-credentials,omitempty"`
+	SpotInterruption  *SpotInterruption `yaml:"spot-interruption" json:"spot-interruption,omitempty"`
+	PrivateIp         *PrivateIpChange  `yaml:"private-ip" json:"private-ip,omitempty"`
+	// Whether the step has run yet
+	Done bool `yaml:"-" json:"done"`
+
+	at time.Duration
+}
+
+// SpotInterruption schedules a spot interruption notice, for the Action (terminate, stop or hibernate) to
+// happen In a duration after the step runs, by default the two minutes notice EC2 gives
+type SpotInterruption struct {
+	Action string `yaml:"action" json:"action"`
+	In     string `yaml:"in" json:"in,omitempty"`
+
+	in time.Duration
+}
+
+// PrivateIpChange replaces the primary private IP of the interface with the given Mac, the primary interface
+// when not set
+type PrivateIpChange struct {
+	Mac string `yaml:"mac" json:"mac,omitempty"`
+	Ip  string `yaml:"ip" json:"ip"`
+}
+
+// readScenario loads and validates a scenario file, rejecting unknown keys to catch typos
+func readScenario(file string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scenario %s: %+v", file, err)
+	}
+	scenario := &Scenario{}
+	if err := yaml.UnmarshalStrict(data, scenario); err != nil {
+		return nil, fmt.Errorf("error parsing scenario %s: %+v", file, err)
+	}
+	for _, step := range scenario.Steps {
+		if err := step.validate(); err != nil {
+			return nil, fmt.Errorf("invalid scenario %s: %+v", file, err)
+		}
+	}
+	sort.SliceStable(scenario.Steps, func(i, j int) bool {
+		return scenario.Steps[i].at < scenario.Steps[j].at
+	})
+	return scenario, nil
+}
+
+func (s *ScenarioStep) validate() error {
+	at, err := time.ParseDuration(s.At)
+	if err != nil || at < 0 {
+		return fmt.Errorf("invalid step at %q, expected a duration such as 30s", s.At)
+	}
+	s.at = at
+	if !s.RotateCredentials && s.SpotInterruption == nil && s.PrivateIp == nil {
+		return fmt.Errorf("step at %s has nothing to do, expected rotate-credentials, spot-interruption or private-ip", s.At)
+	}
+	if si := s.SpotInterruption; si != nil {
+		if si.Action != "terminate" && si.Action != "stop" && si.Action != "hibernate" {
+			return fmt.Errorf("invalid spot interruption action %s, expected terminate, stop or hibernate", si.Action)
+		}
+		si.in = 2 * time.Minute
+		if si.In != "" {
+			in, err := time.ParseDuration(si.In)
+			if err != nil || in < 0 {
+				return fmt.Errorf("invalid spot interruption in %s", si.In)
+			}
+			si.in = in
+		}
+	}
+	if s.PrivateIp != nil && net.ParseIP(s.PrivateIp.Ip).To4() == nil {
+		return fmt.Errorf("invalid private ip %s", s.PrivateIp.Ip)
+	}
+	return nil
+}
+
+// prepareScenario loads ScenarioFile, checking the interfaces it changes exist. A scenario already set, the one
+// running when reloading, is kept and checked against the reloaded interfaces instead.
+func (app *App) prepareScenario() error {
+	scenario := app.scenario
+	if scenario == nil {
+		if app.ScenarioFile == "" {
+			return nil
+		}
+		var err error
+		if scenario, err = readScenario(app.ScenarioFile); err != nil {
+			return err
+		}
+	}
+	for _, step := range scenario.Steps {
+		if step.PrivateIp != nil && app.scenarioInterface(step.PrivateIp) == nil {
+			return fmt.Errorf("invalid scenario %s: no network interface %s", app.ScenarioFile, step.PrivateIp.Mac)
+		}
+	}
+	app.scenario = scenario
+	return nil
+}
+
+func (app *App) scenarioInterface(change *PrivateIpChange) *NetworkInterface {
+	if change.Mac == "" {
+		return app.primaryNetworkInterface()
+	}
+	return app.networkInterface(change.Mac)
+}
+
+// runScenario runs each step of the scenario once the clock reaches its offset from start, taking the same lock
+// as the admin API. Advancing the clock runs the steps it skips over.
+func (app *App) runScenario(scenario *Scenario, start time.Time) {
+	for _, step := range scenario.Steps {
+		app.clock.sleepUntil(start.Add(step.at))
+		app.mu.Lock()
+		app.runScenarioStep(step, app.clock.now())
+		app.mu.Unlock()
+	}
+	log.Infof("Scenario finished")
+}
+
+// runScenarioStep makes the changes of a step, app.mu must be held
+func (app *App) runScenarioStep(step *ScenarioStep, now time.Time) {
+	if step.RotateCredentials {
+		app.credentials.rotate(now)
+		log.Infof("Scenario T+%s: rotated credentials", step.At)
+	}
+	if si := step.SpotInterruption; si != nil {
+		app.spotInstanceAction = &SpotInstanceAction{Action: si.Action, Time: now.Add(si.in)}
+		log.Infof("Scenario T+%s: scheduled spot interruption %s in %s", step.At, si.Action, si.in)
+	}
+	if change := step.PrivateIp; change != nil {
+		// Checked by prepareScenario on startup and reload, but skipped rather than crashing should it be gone
+		if eni := app.scenarioInterface(change); eni == nil {
+			log.Warnf("Scenario T+%s: skipped changing private ip, no network interface %s", step.At, change.Mac)
+		} else {
+			old := app.setPrimaryPrivateIp(eni, change.Ip)
+			log.Infof("Scenario T+%s: changed private ip of %s from %s to %s", step.At, eni.Mac, old, change.Ip)
+		}
+	}
+	step.Done = true
+}
+
+// setPrimaryPrivateIp replaces the primary private IP of the interface, moving the public IP associated with
+// it and the local-hostname derived from it along, and returns the old IP
+func (app *App) setPrimaryPrivateIp(eni *NetworkInterface, ip string) string {
+	if len(eni.LocalIpv4s) == 0 {
+		eni.LocalIpv4s = []string{ip}
+		return ""
+	}
+	old := eni.LocalIpv4s[0]
+	eni.LocalIpv4s[0] = ip
+	for publicIp, privateIp := range eni.Ipv4Associations {
+		if privateIp == old {
+			eni.Ipv4Associations[publicIp] = ip
+		}
+	}
+	if eni.LocalHostname == app.privateDNSName(old) {
+		eni.LocalHostname = app.privateDNSName(ip)
+	}
+	return old
+}
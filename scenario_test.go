@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadScenario(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{
+		"scenario.yaml": `
+steps:
+  - at: 90s
+    private-ip:
+      ip: 10.20.30.99
+  - at: 30s
+    rotate-credentials: true
+  - at: 1m
+    spot-interruption:
+      action: stop
+`,
+		"unknown.yaml": "steps:\n  - at: 30s\n    reboot: true\n",
+		"empty.yaml":   "steps:\n  - at: 30s\n",
+		"at.yaml":      "steps:\n  - at: soon\n    rotate-credentials: true\n",
+		"action.yaml":  "steps:\n  - at: 30s\n    spot-interruption:\n      action: reboot\n",
+		"ip.yaml":      "steps:\n  - at: 30s\n    private-ip:\n      ip: 10.20.30\n",
+	})
+	defer cleanup()
+
+	scenario, err := readScenario(paths["scenario.yaml"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var at []string
+	for _, step := range scenario.Steps {
+		at = append(at, step.At)
+	}
+	if strings.Join(at, " ") != "30s 1m 90s" {
+		t.Errorf("Expected the steps ordered by time, got %v", at)
+	}
+	if si := scenario.Steps[1].SpotInterruption; si.in != 2*time.Minute {
+		t.Errorf("Expected the spot interruption in 2m by default, got %s", si.in)
+	}
+
+	for _, name := range []string{"unknown.yaml", "empty.yaml", "at.yaml", "action.yaml", "ip.yaml"} {
+		if _, err := readScenario(paths[name]); err == nil {
+			t.Errorf("Expected an error reading %s", name)
+		}
+	}
+}
+
+func TestRunScenario(t *testing.T) {
+	app := NewApp()
+	app.AvailabilityZone = "us-east-1a"
+	app.MacAddress = "00:aa:bb:cc:dd:ee"
+	app.PrivateIp = "10.20.30.40"
+	app.PublicIpv4 = "54.10.20.30"
+	if err := app.prepareNetworkInterfaces(); err != nil {
+		t.Fatal(err)
+	}
+	scenario := &Scenario{Steps: []*ScenarioStep{
+		{At: "0s", RotateCredentials: true},
+		{At: "10ms", SpotInterruption: &SpotInterruption{Action: "terminate", In: "30s"}},
+		{At: "20ms", PrivateIp: &PrivateIpChange{Ip: "10.20.30.99"}},
+	}}
+	for _, step := range scenario.Steps {
+		if err := step.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	app.runScenario(scenario, start)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Expected the scenario to take at least 20ms, took %s", elapsed)
+	}
+	for _, step := range scenario.Steps {
+		if !step.Done {
+			t.Errorf("Expected step at %s to be done", step.At)
+		}
+	}
+	if credentials := app.credentials.get(app.clock.now()); credentials.AccessKeyID != "mock-access-key-id-1" {
+		t.Errorf("Expected rotated credentials, got %+v", credentials)
+	}
+	if action := app.spotInstanceAction; action == nil || action.Action != "terminate" ||
+		action.Time.Sub(start) < 30*time.Second {
+		t.Errorf("Expected a terminate action 30s after the step, got %+v", action)
+	}
+	eni := app.primaryNetworkInterface()
+	if app.primaryPrivateIp() != "10.20.30.99" || eni.Ipv4Associations["54.10.20.30"] != "10.20.30.99" ||
+		eni.LocalHostname != "ip-10-20-30-99.ec2.internal" {
+		t.Errorf("Expected the private ip, its public ip and local-hostname changed, got %+v", eni)
+	}
+}
+
+func TestScenarioSpotAndCredentials(t *testing.T) {
+	doNotFoundTest(t, "GET", "/latest/meta-data/spot/instance-action")
+	doAdminTest(t, "GET", "/scenario", 404)
+
+	// The rotated credentials are only served until they expire
+	defer doAdminTest(t, "DELETE", "/clock", 200)
+	doAdminTest(t, "PUT", "/clock?frozen=true&now=2018-02-26T23:50:00Z", 200)
+	testApp.mu.Lock()
+	testApp.runScenarioStep(&ScenarioStep{
+		At:                "30s",
+		RotateCredentials: true,
+		SpotInterruption:  &SpotInterruption{Action: "terminate", in: 2 * time.Minute},
+	}, time.Date(2018, 2, 26, 23, 50, 0, 0, time.UTC))
+	testApp.mu.Unlock()
+	defer func() {
+		testApp.mu.Lock()
+		testApp.spotInstanceAction = nil
+		testApp.mu.Unlock()
+		testApp.credentials.reset()
+	}()
+
+	doBodyTest(t, "GET", "/latest/meta-data/spot/", "instance-action\ntermination-time")
+	doBodyTest(t, "GET", "/latest/meta-data/spot/instance-action", `{"action":"terminate","time":"2018-02-26T23:52:00Z"}`)
+	doBodyTest(t, "GET", "/latest/meta-data/spot/termination-time", "2018-02-26T23:52:00Z")
+	doNotFoundTest(t, "GET", "/2014-02-25/meta-data/spot/termination-time")
+	doNotFoundTest(t, "GET", "/2016-09-02/meta-data/spot/instance-action")
+	if body := doGetBody(t, "/latest/meta-data/"); !strings.Contains(body, "\nspot/\n") {
+		t.Errorf("Expected spot/ to be listed, got %s", body)
+	}
+	doBodyTest(t, "GET", "/latest/meta-data/iam/security-credentials/some-instance-profile", `{
+  "Code" : "Success",
+  "LastUpdated" : "2018-02-26T23:50:00Z",
+  "Type" : "AWS-HMAC",
+  "AccessKeyId" : "mock-access-key-id-1",
+  "SecretAccessKey" : "mock-secret-access-key-1",
+  "Token" : "mock-token-1",
+  "Expiration" : "2018-02-27T05:50:00Z"
+}`)
+}
@@ -1,27 +1,164 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
-	"github.com/gorilla/mux"
 )
 
-// StartServer starts a newly created http server
+// StartServer starts the metadata servers, and the admin API when enabled, and runs them until SIGTERM or SIGINT,
+// reloading the configuration on SIGHUP or when the config file changes
 func (app *App) StartServer() {
-	log.Infof("Listening on port %s:%s", app.AppInterface, app.AppPort)
-	if err := http.ListenAndServe(app.AppInterface+":"+app.AppPort, app.NewServer()); err != nil {
-		log.Fatalf("Error creating http server: %+v", err)
+	if err := app.prepare(); err != nil {
+		log.Fatalf("Error preparing server: %+v", err)
 	}
+	handler := app.NewServer()
+	servers := []*http.Server{app.newHTTPServer(app.AppInterface+":"+app.AppPort, handler)}
+	if app.AppInterfaceIpv6 != "" {
+		// The IPv6 endpoint (normally fd00:ec2::254) is served alongside the IPv4 one
+		servers = append(servers, app.newHTTPServer(net.JoinHostPort(app.AppInterfaceIpv6, app.AppPort), handler))
+	}
+	var admin *http.Server
+	if app.AdminPort != "" {
+		admin = app.newHTTPServer(app.AdminInterface+":"+app.AdminPort, app.NewAdminServer())
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	errs := make(chan error, len(servers)+1)
+	for _, s := range servers {
+		log.Infof("Listening on port %s", s.Addr)
+		go serve(s, errs)
+	}
+	if admin != nil {
+		log.Infof("Admin API listening on port %s", admin.Addr)
+		go serve(admin, errs)
+	}
+	go app.waitForCredentials()
+	if app.scenario != nil {
+		go app.runScenario(app.scenario, app.clock.now())
+	}
+	if app.ConfigFile != "" {
+		go app.watchConfigFile(app.ConfigFile)
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			log.Fatalf("Error creating http server: %+v", err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				app.reloadOn("SIGHUP")
+				continue
+			}
+			log.Infof("Received %s, shutting down", sig)
+			app.shutdown(servers, admin)
+			return
+		}
+	}
+}
+
+// newHTTPServer creates a server with the configured timeouts
+func (app *App) newHTTPServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         address,
+		Handler:      handler,
+		ReadTimeout:  app.ReadTimeout,
+		WriteTimeout: app.WriteTimeout,
+		IdleTimeout:  app.IdleTimeout,
+	}
+}
+
+func serve(s *http.Server, errs chan<- error) {
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		errs <- err
+	}
+}
+
+// shutdown stops accepting connections and waits up to ShutdownTimeout for the requests in flight to be served.
+// The admin API reports the server as not ready until the metadata servers are drained.
+func (app *App) shutdown(servers []*http.Server, admin *http.Server) {
+	app.readiness.drain()
+	app.mu.RLock()
+	timeout := app.ShutdownTimeout
+	app.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Errorf("Error shutting down %s: %+v", s.Addr, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	if admin != nil {
+		if err := admin.Shutdown(ctx); err != nil {
+			log.Errorf("Error shutting down the admin API: %+v", err)
+		}
+	}
+	log.Infof("Shut down")
+}
+
+// prepare validates the parameters and sets up the state derived from them, it must be called before NewServer
+func (app *App) prepare() error {
+	if err := app.prepareClock(); err != nil {
+		return err
+	}
+	app.launchTime = app.clock.now()
+	if app.LaunchTime != "" {
+		t, err := time.Parse(time.RFC3339, app.LaunchTime)
+		if err != nil {
+			return fmt.Errorf("invalid launch time %s: %+v", app.LaunchTime, err)
+		}
+		app.launchTime = t.UTC()
+	}
+	if err := app.prepareNetworkInterfaces(); err != nil {
+		return err
+	}
+	if err := app.prepareBlockDeviceMappings(); err != nil {
+		return err
+	}
+	if err := app.prepareMetadataOptions(); err != nil {
+		return err
+	}
+	app.faults.remove(0)
+	if err := app.faults.add(app.Faults...); err != nil {
+		return err
+	}
+	if err := app.prepareScenario(); err != nil {
+		return err
+	}
+	if app.PublicKeyFile != "" {
+		key, err := ioutil.ReadFile(app.PublicKeyFile)
+		if err != nil {
+			return fmt.Errorf("error reading public key: %+v", err)
+		}
+		app.PublicKeys = append([]PublicKey{{Name: app.KeyName, OpensshKey: strings.TrimSpace(string(key))}}, app.PublicKeys...)
+	}
+	if err := app.loadIdentitySigner(); err != nil {
+		return fmt.Errorf("error loading instance identity signer: %+v", err)
+	}
+	return nil
 }
 
 func (app *App) apiVersionPrefixes() []string {
@@ -43,38 +180,52 @@ func (app *App) apiVersionPrefixes() []string {
 		"2016-04-19",
 		"2016-06-30",
 		"2016-09-02",
+		"2018-03-28",
+		"2018-08-17",
+		"2018-09-24",
+		"2019-10-01",
+		"2020-10-27",
+		"2021-01-03",
+		"2021-03-23",
+		"2021-07-15",
+		"2022-09-24",
 		"latest",
 	}
 }
 
 // NewServer creates a new http server (starting handled separately to allow test suites to reuse)
-func (app *App) NewServer() *mux.Router {
-	r := mux.NewRouter()
-	r.Handle("", appHandler(app.rootHandler))
-	r.Handle("/", appHandler(app.rootHandler))
+func (app *App) NewServer() http.Handler {
+	app.router = app.newRouter()
 
-	for _, v := range app.apiVersionPrefixes() {
-		app.versionSubRouter(r.PathPrefix(fmt.Sprintf("/%s", v)).Subrouter(), v)
-	}
-
-	r.Handle("/{path:.*}", appHandler(app.notFoundHandler))
+	// Innermost first, the router is read under readLocked's lock as reload replaces it
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.router.ServeHTTP(w, r)
+	})
+	h = app.checkToken(h)
+	h = app.rateLimit(h)
+	h = app.readLocked(h)
+	h = app.imdsResponses(h)
+	h = app.injectFaults(h)
+	h = app.enforceMetadataOptions(h)
+	return app.observeRequests(h)
+}
 
-	return r
+// newRouter builds the router for the current parameters, which decide some of the routes
+func (app *App) newRouter() *router {
+	rt := newRouter(app.apiVersionPrefixes(), appHandler(app.rootHandler), appHandler(app.notFoundHandler),
+		appHandler(app.trailingSlashRedirect))
+	rt.noRedirects = func() bool { return app.NoRedirects }
+	app.routes(rt)
+	return rt
 }
 
-// Provides the versioned (normally 1.0, YYYY-MM-DD or latest) prefix routes
-// TODO: conditional out the namespaces that don't exist on selected API versions
-func (app *App) versionSubRouter(sr *mux.Router, version string) {
-	//sr.Handle("", appHandler(app.trailingSlashRedirect))
-	sr.Handle("", appHandler(app.secondLevelHandler))
-	sr.Handle("/", appHandler(app.secondLevelHandler))
+// Provides the routes below the version (normally 1.0, YYYY-MM-DD or latest) prefix, keys that
+// don't exist on the requested API version are left out (see keyVersions)
+func (app *App) routes(rt *router) {
+	rt.key("", appHandler(app.secondLevelHandler))
 
 	// For IMDSv2, https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/configuring-instance-metadata-service.html
-	a := sr.PathPrefix("/api").Subrouter()
-	a.Handle("", appHandler(app.notFoundHandler))
-	a.Handle("/", appHandler(app.notFoundHandler))
-	a.Handle("/token", appHandler(app.apiTokenHandler)).Methods("PUT")
-	// TODO: return 405 for everything but PUT
+	// Everything but PUT is a 405
 	/*
 		HTTP/1.1 405 Not Allowed
 		Allow: OPTIONS, PUT
@@ -84,127 +235,120 @@ func (app *App) versionSubRouter(sr *mux.Router, version string) {
 		Connection: close
 		Content-Type: text/plain
 	*/
-	a.Handle("/token", appHandler(app.apiTokenNotPutHandler)).Methods("GET", "POST", "DELETE")
-
-	d := sr.PathPrefix("/dynamic").Subrouter()
-	d.Handle("", appHandler(app.trailingSlashRedirect))
-	d.Handle("/", appHandler(app.dynamicHandler))
-
-	ii := d.PathPrefix("/instance-identity").Subrouter()
-	ii.Handle("", appHandler(app.trailingSlashRedirect))
-	ii.Handle("/", appHandler(app.instanceIdentityHandler))
-	ii.Handle("/document", appHandler(app.instanceIdentityDocumentHandler))
-	ii.Handle("/document/", appHandler(app.instanceIdentityDocumentHandler))
-	ii.Handle("/pkcs7", appHandler(app.instanceIdentityPkcs7Handler))
-	ii.Handle("/pkcs7/", appHandler(app.instanceIdentityPkcs7Handler))
-	ii.Handle("/signature", appHandler(app.instanceIdentitySignatureHandler))
-	ii.Handle("/signature/", appHandler(app.instanceIdentitySignatureHandler))
-
-	m := sr.PathPrefix("/meta-data").Subrouter()
-	m.Handle("", appHandler(app.trailingSlashRedirect))
-	m.Handle("/", appHandler(app.metaDataHandler))
-	m.Handle("/ami-id", appHandler(app.amiIdHandler))
-	m.Handle("/ami-id/", appHandler(app.amiIdHandler))
-	m.Handle("/ami-launch-index", appHandler(app.amiLaunchIndexHandler))
-	m.Handle("/ami-launch-index/", appHandler(app.amiLaunchIndexHandler))
-	m.Handle("/ami-manifest-path", appHandler(app.amiManifestPathHandler))
-	m.Handle("/ami-manifest-path/", appHandler(app.amiManifestPathHandler))
-
-	bdm := m.PathPrefix("/block-device-mapping").Subrouter()
-	bdm.Handle("", appHandler(app.trailingSlashRedirect))
-	bdm.Handle("/", appHandler(app.blockDeviceMappingHandler))
-	bdm.Handle("/ami", appHandler(app.blockDeviceMappingAmiHandler))
-	bdm.Handle("/ami/", appHandler(app.blockDeviceMappingAmiHandler))
-	bdm.Handle("/root", appHandler(app.blockDeviceMappingRootHandler))
-	bdm.Handle("/root/", appHandler(app.blockDeviceMappingRootHandler))
-
-	m.Handle("/hostname", appHandler(app.hostnameHandler))
-	m.Handle("/hostname/", appHandler(app.hostnameHandler))
-
-	i := m.PathPrefix("/iam").Subrouter()
-	i.Handle("", appHandler(app.trailingSlashRedirect))
-	i.Handle("/", appHandler(app.iamHandler))
-	i.Handle("/info", appHandler(app.infoHandler))
-	i.Handle("/info/", appHandler(app.infoHandler))
-	isc := i.PathPrefix("/security-credentials").Subrouter()
-	isc.Handle("", appHandler(app.trailingSlashRedirect))
-	isc.Handle("/", appHandler(app.securityCredentialsHandler))
+	rt.handle("api/token", appHandler(app.apiTokenNotPutHandler))
+	rt.methods("api/token", appHandler(app.apiTokenHandler), "PUT")
+
+	rt.dir("dynamic", appHandler(app.dynamicHandler))
+
+	rt.dir("dynamic/instance-identity", appHandler(app.instanceIdentityHandler))
+	rt.key("dynamic/instance-identity/document", appHandler(app.instanceIdentityDocumentHandler))
+	rt.key("dynamic/instance-identity/pkcs7", appHandler(app.instanceIdentityPkcs7Handler))
+	rt.key("dynamic/instance-identity/rsa2048", appHandler(app.instanceIdentityRsa2048Handler))
+	rt.key("dynamic/instance-identity/signature", appHandler(app.instanceIdentitySignatureHandler))
+
+	rt.dir("meta-data", appHandler(app.metaDataHandler))
+	rt.key("meta-data/ami-id", appHandler(app.amiIdHandler))
+	rt.key("meta-data/ami-launch-index", appHandler(app.amiLaunchIndexHandler))
+	rt.key("meta-data/ami-manifest-path", appHandler(app.amiManifestPathHandler))
+
+	rt.dir("meta-data/block-device-mapping", appHandler(app.blockDeviceMappingHandler))
+	rt.key("meta-data/block-device-mapping/{name}", appHandler(app.blockDeviceMappingNameHandler))
+
+	rt.key("meta-data/hostname", appHandler(app.hostnameHandler))
+
+	rt.dir("meta-data/iam", appHandler(app.iamHandler))
+	rt.key("meta-data/iam/info", appHandler(app.infoHandler))
+	rt.dir("meta-data/iam/security-credentials", appHandler(app.securityCredentialsHandler))
 	if app.MockInstanceProfile == true {
-		isc.Handle("/"+app.RoleName, appHandler(app.mockRoleHandler))
-		isc.Handle("/"+app.RoleName+"/", appHandler(app.mockRoleHandler))
+		rt.key("meta-data/iam/security-credentials/"+app.RoleName, appHandler(app.mockRoleHandler))
 	} else {
-		isc.Handle("/"+app.RoleName, appHandler(app.roleHandler))
-		isc.Handle("/"+app.RoleName+"/", appHandler(app.roleHandler))
-	}
-
-	m.Handle("/instance-action", appHandler(app.instanceActionHandler))
-	m.Handle("/instance-action/", appHandler(app.instanceActionHandler))
-	m.Handle("/instance-id", appHandler(app.instanceIDHandler))
-	m.Handle("/instance-id/", appHandler(app.instanceIDHandler))
-	m.Handle("/instance-type", appHandler(app.instanceTypeHandler))
-	m.Handle("/instance-type/", appHandler(app.instanceTypeHandler))
-	m.Handle("/local-hostname", appHandler(app.localHostnameHandler))
-	m.Handle("/local-hostname/", appHandler(app.localHostnameHandler))
-	m.Handle("/local-ipv4", appHandler(app.privateIpHandler))
-	m.Handle("/local-ipv4/", appHandler(app.privateIpHandler))
-	m.Handle("/mac", appHandler(app.macHandler))
-	m.Handle("/mac/", appHandler(app.macHandler))
-
-	me := m.PathPrefix("/metrics").Subrouter()
-	me.Handle("", appHandler(app.trailingSlashRedirect))
-	me.Handle("/", appHandler(app.metricsHandler))
-	me.Handle("/vhostmd", appHandler(app.metricsVhostmdHandler))
-	me.Handle("/vhostmd/", appHandler(app.metricsVhostmdHandler))
-
-	n := m.PathPrefix("/network").Subrouter()
-	n.Handle("", appHandler(app.trailingSlashRedirect))
-	n.Handle("/", appHandler(app.networkHandler))
-	ni := n.PathPrefix("/interfaces").Subrouter()
-	ni.Handle("", appHandler(app.trailingSlashRedirect))
-	ni.Handle("/", appHandler(app.networkInterfacesHandler))
-	nim := ni.PathPrefix("/macs").Subrouter()
-	nim.Handle("", appHandler(app.trailingSlashRedirect))
-	nim.Handle("/", appHandler(app.networkInterfacesMacsHandler))
-	nimaddr := nim.PathPrefix("/" + app.MacAddress).Subrouter()
-	nimaddr.Handle("", appHandler(app.trailingSlashRedirect))
-	nimaddr.Handle("/", appHandler(app.networkInterfacesMacsAddrHandler))
-	nimaddr.Handle("/device-number", appHandler(app.nimAddrDeviceNumberHandler))
-	nimaddr.Handle("/device-number/", appHandler(app.nimAddrDeviceNumberHandler))
-	nimaddr.Handle("/interface-id", appHandler(app.nimAddrInterfaceIdHandler))
-	nimaddr.Handle("/interface-id/", appHandler(app.nimAddrInterfaceIdHandler))
-	// TODO: expand API coverage
-	nimaddr.Handle("/vpc-id", appHandler(app.vpcHandler))
-
-	p := m.PathPrefix("/placement").Subrouter()
-	p.Handle("/availability-zone", appHandler(app.availabilityZoneHandler))
-	p.Handle("/region", appHandler(app.regionHandler))
-
-	m.Handle("/profile", appHandler(app.profileHandler))
-	m.Handle("/profile/", appHandler(app.profileHandler))
-	m.Handle("/public-hostname", appHandler(app.hostnameHandler))
-	m.Handle("/public-hostname/", appHandler(app.hostnameHandler))
-
-	sr.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	a.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	d.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	ii.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	m.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	bdm.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	i.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	isc.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	me.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	n.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	ni.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	nim.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	nimaddr.Handle("/{path:.*}", appHandler(app.notFoundHandler))
-	p.Handle("/{path:.*}", appHandler(app.notFoundHandler))
+		rt.key("meta-data/iam/security-credentials/"+app.RoleName, appHandler(app.roleHandler))
+	}
+
+	rt.key("meta-data/instance-action", appHandler(app.instanceActionHandler))
+	rt.key("meta-data/instance-id", appHandler(app.instanceIDHandler))
+	rt.key("meta-data/instance-type", appHandler(app.instanceTypeHandler))
+	rt.key("meta-data/ipv6", appHandler(app.ipv6Handler))
+	rt.key("meta-data/kernel-id", appHandler(app.kernelIdHandler))
+	rt.key("meta-data/local-hostname", appHandler(app.localHostnameHandler))
+	rt.key("meta-data/local-ipv4", appHandler(app.privateIpHandler))
+	rt.key("meta-data/mac", appHandler(app.macHandler))
+
+	rt.dir("meta-data/metrics", appHandler(app.metricsHandler))
+	rt.key("meta-data/metrics/vhostmd", appHandler(app.metricsVhostmdHandler))
+
+	rt.dir("meta-data/network", appHandler(app.networkHandler))
+	rt.dir("meta-data/network/interfaces", appHandler(app.networkInterfacesHandler))
+	rt.dir("meta-data/network/interfaces/macs", appHandler(app.networkInterfacesMacsHandler))
+	rt.handle("meta-data/network/interfaces/macs/{mac}", app.interfaceHandler(app.nimAddrRedirectHandler))
+	rt.handle("meta-data/network/interfaces/macs/{mac}/", app.interfaceHandler(app.networkInterfacesMacsAddrHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/device-number", app.interfaceHandler(app.nimAddrDeviceNumberHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/interface-id", app.interfaceHandler(app.nimAddrInterfaceIdHandler))
+	rt.handle("meta-data/network/interfaces/macs/{mac}/ipv4-associations", app.interfaceHandler(app.nimAddrRedirectHandler))
+	rt.handle("meta-data/network/interfaces/macs/{mac}/ipv4-associations/", app.interfaceHandler(app.nimAddrIpv4AssociationsHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/ipv4-associations/{ip}", app.interfaceHandler(app.nimAddrIpv4AssociationHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/ipv6s", app.interfaceHandler(app.nimAddrIpv6sHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/local-hostname", app.interfaceHandler(app.nimAddrLocalHostnameHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/local-ipv4s", app.interfaceHandler(app.nimAddrLocalIpv4sHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/mac", app.interfaceHandler(app.nimAddrMacHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/owner-id", app.interfaceHandler(app.nimAddrOwnerIdHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/public-hostname", app.interfaceHandler(app.nimAddrPublicHostnameHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/public-ipv4s", app.interfaceHandler(app.nimAddrPublicIpv4sHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/security-group-ids", app.interfaceHandler(app.nimAddrSecurityGroupIdsHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/security-groups", app.interfaceHandler(app.nimAddrSecurityGroupsHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/subnet-id", app.interfaceHandler(app.nimAddrSubnetIdHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/subnet-ipv4-cidr-block", app.interfaceHandler(app.nimAddrSubnetIpv4CidrBlockHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/subnet-ipv6-cidr-blocks", app.interfaceHandler(app.nimAddrSubnetIpv6CidrBlocksHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/vpc-id", app.interfaceHandler(app.nimAddrVpcIdHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/vpc-ipv4-cidr-block", app.interfaceHandler(app.nimAddrVpcIpv4CidrBlockHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/vpc-ipv4-cidr-blocks", app.interfaceHandler(app.nimAddrVpcIpv4CidrBlocksHandler))
+	rt.key("meta-data/network/interfaces/macs/{mac}/vpc-ipv6-cidr-blocks", app.interfaceHandler(app.nimAddrVpcIpv6CidrBlocksHandler))
+
+	rt.dir("meta-data/placement", appHandler(app.placementHandler))
+	rt.key("meta-data/placement/availability-zone", appHandler(app.availabilityZoneHandler))
+	rt.key("meta-data/placement/availability-zone-id", appHandler(app.availabilityZoneIDHandler))
+	if app.PlacementGroupName != "" {
+		rt.key("meta-data/placement/group-name", appHandler(app.placementGroupNameHandler))
+	}
+	if app.HostID != "" {
+		rt.key("meta-data/placement/host-id", appHandler(app.hostIDHandler))
+	}
+	if app.PlacementPartitionNumber > 0 {
+		rt.key("meta-data/placement/partition-number", appHandler(app.placementPartitionNumberHandler))
+	}
+	rt.key("meta-data/placement/region", appHandler(app.regionHandler))
+
+	rt.dir("meta-data/services", appHandler(app.servicesHandler))
+	rt.key("meta-data/services/domain", appHandler(app.servicesDomainHandler))
+	rt.key("meta-data/services/partition", appHandler(app.servicesPartitionHandler))
+
+	rt.key("meta-data/product-codes", appHandler(app.productCodesHandler))
+	rt.key("meta-data/profile", appHandler(app.profileHandler))
+	rt.key("meta-data/public-hostname", appHandler(app.publicHostnameHandler))
+	rt.key("meta-data/public-ipv4", appHandler(app.publicIpv4Handler))
+
+	rt.dir("meta-data/public-keys", appHandler(app.publicKeysHandler))
+	rt.key("meta-data/public-keys/{index}", appHandler(app.publicKeyHandler))
+	rt.key("meta-data/public-keys/{index}/openssh-key", appHandler(app.publicKeyOpensshKeyHandler))
+
+	rt.key("meta-data/ramdisk-id", appHandler(app.ramdiskIdHandler))
+	rt.key("meta-data/reservation-id", appHandler(app.reservationIdHandler))
+	rt.key("meta-data/security-groups", appHandler(app.securityGroupsHandler))
+
+	rt.dir("meta-data/spot", appHandler(app.spotHandler))
+	rt.key("meta-data/spot/instance-action", appHandler(app.spotInstanceActionHandler))
+	rt.key("meta-data/spot/termination-time", appHandler(app.spotTerminationTimeHandler))
+
+	rt.handle("meta-data/tags", appHandler(app.tagsHandler(app.trailingSlashRedirect)))
+	rt.handle("meta-data/tags/", appHandler(app.tagsHandler(app.tagsListHandler)))
+	rt.handle("meta-data/tags/instance", appHandler(app.tagsHandler(app.trailingSlashRedirect)))
+	rt.handle("meta-data/tags/instance/", appHandler(app.tagsHandler(app.tagsInstanceHandler)))
+	rt.key("meta-data/tags/instance/{key}", appHandler(app.tagsHandler(app.tagsInstanceKeyHandler)))
 }
 
 type appHandler func(http.ResponseWriter, *http.Request)
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Infof("Requesting %s", r.RequestURI)
-	w.Header().Set("Server", "EC2ws")
 	fn(w, r)
 }
 
@@ -213,19 +357,32 @@ func (app *App) rootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *App) trailingSlashRedirect(w http.ResponseWriter, r *http.Request) {
-	location := ""
-	if app.NoSchemeHostRedirects == false {
-		location = "http://169.254.169.254"
+	location := app.redirectBaseURL(r) + r.URL.EscapedPath() + "/"
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
 	}
-	location = fmt.Sprintf("%s%s/", location, r.URL.String())
 	w.Header().Set("Location", location)
 	w.WriteHeader(301)
 }
 
+// redirectBaseURL returns the scheme://host prefix of Location redirect headers, for clients that reach the
+// server on another address than 169.254.169.254 (port forwarding, non-standard ports, proxies)
+func (app *App) redirectBaseURL(r *http.Request) string {
+	switch {
+	case app.NoSchemeHostRedirects:
+		return ""
+	case app.RedirectToRequestHost:
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		return scheme + "://" + r.Host
+	}
+	return strings.TrimSuffix(app.RedirectBaseURL, "/")
+}
+
 func (app *App) secondLevelHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, `dynamic
-meta-data
-user-data`)
+	writeListing(w, r, []string{"dynamic", "meta-data", "user-data"})
 }
 
 func (app *App) dynamicHandler(w http.ResponseWriter, r *http.Request) {
@@ -238,24 +395,23 @@ func (app *App) apiTokenNotPutHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(405)
 }
 
-// NOTE: no API methods actually check the X-aws-ec2-metadata-token request header right now...
+// Issues an IMDSv2 session token, see checkToken for how they are checked
 func (app *App) apiTokenHandler(w http.ResponseWriter, r *http.Request) {
-	// Check for X-aws-ec2-metadata-token-ttl-seconds request header
-	if r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
-		// Not set, 400 Bad Request
-		w.WriteHeader(400)
+	// IMDS refuses to issue tokens to requests that went through a proxy
+	if r.Header.Get("X-Forwarded-For") != "" {
+		writeError(w, 403)
+		return
 	}
 
-	// Check X-aws-ec2-metadata-token-ttl-seconds is an integer
+	// Check X-aws-ec2-metadata-token-ttl-seconds is set, and an integer within the limits
 	seconds_int, err := strconv.Atoi(r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
-	if err != nil {
-		log.Errorf("apiTokenHandler: Error converting X-aws-ec2-metadata-token-ttl-seconds to integer: %+v", err)
-		w.WriteHeader(400)
+	if err != nil || seconds_int < minTokenTTL || seconds_int > maxTokenTTL {
+		log.Errorf("apiTokenHandler: Invalid X-aws-ec2-metadata-token-ttl-seconds %q", r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+		writeError(w, 400)
+		return
 	}
 
-	// Generate a token, 40 character string, base64 encoded
-	token := base64.StdEncoding.EncodeToString([]byte(RandStringBytesMaskImprSrc(40)))
-
+	token := app.tokens.issue(seconds_int, app.clock.now())
 	w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", strconv.Itoa(seconds_int))
 	write(w, token)
 }
@@ -263,89 +419,145 @@ func (app *App) apiTokenHandler(w http.ResponseWriter, r *http.Request) {
 func (app *App) instanceIdentityHandler(w http.ResponseWriter, r *http.Request) {
 	write(w, `document
 pkcs7
+rsa2048
 signature
 `)
 }
 
 type InstanceIdentityDocument struct {
-	InstanceId         string  `json:"instanceId"`
-	BillingProducts    *string `json:"billingProducts"`
-	ImageId            string  `json:"imageId"`
-	Architecture       string  `json:"architecture"`
-	PendingTime        string  `json:"pendingTime"`
-	InstanceType       string  `json:"instanceType"`
-	AccountId          string  `json:"accountId"`
-	KernelId           *string `json:"kernelId"`
-	RamdiskId          *string `json:"ramdiskId"`
-	Region             string  `json:"region"`
-	Version            string  `json:"version"`
-	AvailabilityZone   string  `json:"availabilityZone"`
-	DevpayProductCodes *string `json:"devpayProductCodes"`
-	PrivateIp          string  `json:"privateIp"`
+	InstanceId              string   `json:"instanceId"`
+	BillingProducts         []string `json:"billingProducts"`
+	ImageId                 string   `json:"imageId"`
+	Architecture            string   `json:"architecture"`
+	PendingTime             string   `json:"pendingTime"`
+	InstanceType            string   `json:"instanceType"`
+	AccountId               string   `json:"accountId"`
+	KernelId                *string  `json:"kernelId"`
+	RamdiskId               *string  `json:"ramdiskId"`
+	Region                  string   `json:"region"`
+	Version                 string   `json:"version"`
+	AvailabilityZone        string   `json:"availabilityZone"`
+	DevpayProductCodes      []string `json:"devpayProductCodes"`
+	MarketplaceProductCodes []string `json:"marketplaceProductCodes"`
+	PrivateIp               string   `json:"privateIp"`
+}
+
+func (app *App) instanceIdentityDocument() ([]byte, error) {
+	document := InstanceIdentityDocument{
+		AvailabilityZone:        app.AvailabilityZone,
+		Region:                  app.region(),
+		DevpayProductCodes:      app.DevpayProductCodes,
+		MarketplaceProductCodes: app.MarketplaceProductCodes,
+		PrivateIp:               app.primaryPrivateIp(),
+		Version:                 app.IdentityDocumentVersion,
+		InstanceId:              app.InstanceID,
+		BillingProducts:         app.BillingProducts,
+		InstanceType:            app.InstanceType,
+		AccountId:               app.AccountID,
+		ImageId:                 app.AmiID,
+		PendingTime:             app.launchTime.Format("2006-01-02T15:04:05Z"),
+		Architecture:            app.Architecture,
+		KernelId:                optionalString(app.KernelID),
+		RamdiskId:               optionalString(app.RamdiskID),
+	}
+	return json.MarshalIndent(document, "", "  ")
 }
 
 func (app *App) instanceIdentityDocumentHandler(w http.ResponseWriter, r *http.Request) {
-	document := InstanceIdentityDocument{
-		AvailabilityZone:   app.AvailabilityZone,
-		Region:             app.AvailabilityZone[:len(app.AvailabilityZone)-1],
-		DevpayProductCodes: nil,
-		PrivateIp:          app.PrivateIp,
-		Version:            "2010-08-31",
-		InstanceId:         app.InstanceID,
-		BillingProducts:    nil,
-		InstanceType:       app.InstanceType,
-		AccountId:          app.AccountID,
-		ImageId:            app.AmiID,
-		PendingTime:        "2016-04-15T12:14:15Z",
-		Architecture:       "x86_64",
-		KernelId:           nil,
-		RamdiskId:          nil,
-	}
-	result, err := json.MarshalIndent(document, "", "  ")
+	result, err := app.instanceIdentityDocument()
 	if err != nil {
 		log.Errorf("Error marshalling json %+v", err)
 		http.Error(w, err.Error(), 500)
+		return
 	}
 	write(w, string(result))
 }
 
-// We cannot impersonate AWS and generate matching signatures here.
-// Just return placeholder data instead.
+// The signatures are real, but made with the local identity key (see --identity-cert-file)
+// rather than the AWS regional certificates.
 // https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instance-identity-documents.html
 func (app *App) instanceIdentityPkcs7Handler(w http.ResponseWriter, r *http.Request) {
-	write(w, `PKCS7`)
+	app.signedIdentityHandler(w, app.identitySigner.pkcs7)
+}
+
+// On AWS rsa2048 differs from pkcs7 by being signed with a SHA-256/RSA-2048 certificate,
+// which is what the local identity key already is.
+func (app *App) instanceIdentityRsa2048Handler(w http.ResponseWriter, r *http.Request) {
+	app.signedIdentityHandler(w, app.identitySigner.pkcs7)
 }
 
-// We cannot impersonate AWS and generate matching signatures here.
-// Just return placeholder data instead.
-// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instance-identity-documents.html
 func (app *App) instanceIdentitySignatureHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, `SIGNATURE`)
+	app.signedIdentityHandler(w, app.identitySigner.signature)
+}
+
+func (app *App) signedIdentityHandler(w http.ResponseWriter, sign func([]byte) (string, error)) {
+	document, err := app.instanceIdentityDocument()
+	if err != nil {
+		log.Errorf("Error marshalling json %+v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	signature, err := sign(document)
+	if err != nil {
+		log.Errorf("Error signing instance identity document %+v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	write(w, signature)
 }
 
 func (app *App) metaDataHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO: if IAM Role/Instance Profile is disabled, don't add iam/ to the list (same behavior as real metadata service)
-	write(w, `ami-id
-ami-launch-index
-ami-manifest-path
-block-device-mapping/
-hostname
-iam/
-instance-action
-instance-id
-instance-type
-local-hostname
-local-ipv4
-mac
-metrics/
-network/
-placement/
-profile
-public-hostname
-public-ipv4
-reservation-id
-security-groups
-services/`)
+	keys := []string{
+		"ami-id",
+		"ami-launch-index",
+		"ami-manifest-path",
+		"block-device-mapping/",
+		"hostname",
+		"iam/",
+		"instance-action",
+		"instance-id",
+		"instance-type",
+	}
+	if app.primaryIpv6() != "" {
+		keys = append(keys, "ipv6")
+	}
+	if app.KernelID != "" {
+		keys = append(keys, "kernel-id")
+	}
+	keys = append(keys,
+		"local-hostname",
+		"local-ipv4",
+		"mac",
+		"metrics/",
+		"network/",
+		"placement/",
+	)
+	if len(app.MarketplaceProductCodes) > 0 {
+		keys = append(keys, "product-codes")
+	}
+	keys = append(keys, "profile")
+	if app.primaryPublicIpv4() != "" {
+		keys = append(keys, "public-hostname", "public-ipv4")
+	}
+	if len(app.PublicKeys) > 0 {
+		keys = append(keys, "public-keys/")
+	}
+	if app.RamdiskID != "" {
+		keys = append(keys, "ramdisk-id")
+	}
+	keys = append(keys,
+		"reservation-id",
+		"security-groups",
+		"services/",
+	)
+	if app.spotInstanceAction != nil {
+		keys = append(keys, "spot/")
+	}
+	if app.InstanceMetadataTags {
+		keys = append(keys, "tags/")
+	}
+	writeListing(w, r, keys)
 }
 
 func (app *App) amiIdHandler(w http.ResponseWriter, r *http.Request) {
@@ -360,20 +572,6 @@ func (app *App) amiManifestPathHandler(w http.ResponseWriter, r *http.Request) {
 	write(w, "(unknown)")
 }
 
-func (app *App) blockDeviceMappingHandler(w http.ResponseWriter, r *http.Request) {
-	// Not exposing any extra volumes for now, this is pretty standard for an EBS backed EC2 instance.
-	write(w, `ami
-root`)
-}
-
-func (app *App) blockDeviceMappingAmiHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, "/dev/xvda")
-}
-
-func (app *App) blockDeviceMappingRootHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, "/dev/xvda")
-}
-
 func (app *App) hostnameHandler(w http.ResponseWriter, r *http.Request) {
 	write(w, app.Hostname)
 }
@@ -384,12 +582,12 @@ security-credentials/`)
 }
 
 func (app *App) infoHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, `{
+	write(w, fmt.Sprintf(`{
   "Code" : "Success",
   "LastUpdated" : "2018-02-26T23:50:00Z",
-  "InstanceProfileArn" : "arn:aws:iam::123456789012:instance-profile/some-instance-profile",
+  "InstanceProfileArn" : "%s",
   "InstanceProfileId" : "some-instance-profile-id"
-}`)
+}`, app.arn("iam", "instance-profile/"+app.RoleName)))
 }
 
 func (app *App) instanceActionHandler(w http.ResponseWriter, r *http.Request) {
@@ -404,16 +602,47 @@ func (app *App) instanceTypeHandler(w http.ResponseWriter, r *http.Request) {
 	write(w, app.InstanceType)
 }
 
+func (app *App) kernelIdHandler(w http.ResponseWriter, r *http.Request) {
+	app.optionalHandler(w, r, app.KernelID)
+}
+
 func (app *App) localHostnameHandler(w http.ResponseWriter, r *http.Request) {
 	write(w, app.Hostname)
 }
 
+func (app *App) ipv6Handler(w http.ResponseWriter, r *http.Request) {
+	ipv6 := app.primaryIpv6()
+	if ipv6 == "" {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, ipv6)
+}
+
+func (app *App) publicHostnameHandler(w http.ResponseWriter, r *http.Request) {
+	hostname := app.primaryPublicHostname()
+	if hostname == "" {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, hostname)
+}
+
+func (app *App) publicIpv4Handler(w http.ResponseWriter, r *http.Request) {
+	publicIp := app.primaryPublicIpv4()
+	if publicIp == "" {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, publicIp)
+}
+
 func (app *App) privateIpHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, app.PrivateIp)
+	write(w, app.primaryPrivateIp())
 }
 
 func (app *App) macHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, app.MacAddress)
+	write(w, app.primaryMac())
 }
 
 func (app *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
@@ -437,51 +666,174 @@ func (app *App) availabilityZoneHandler(w http.ResponseWriter, r *http.Request)
 	write(w, app.AvailabilityZone)
 }
 
+func (app *App) availabilityZoneIDHandler(w http.ResponseWriter, r *http.Request) {
+	write(w, app.availabilityZoneID())
+}
+
+func (app *App) placementHandler(w http.ResponseWriter, r *http.Request) {
+	// group-name, host-id and partition-number only exist for instances in a placement group or on a dedicated host
+	keys := []string{"availability-zone", "availability-zone-id"}
+	if app.PlacementGroupName != "" {
+		keys = append(keys, "group-name")
+	}
+	if app.HostID != "" {
+		keys = append(keys, "host-id")
+	}
+	if app.PlacementPartitionNumber > 0 {
+		keys = append(keys, "partition-number")
+	}
+	keys = append(keys, "region")
+	writeListing(w, r, keys)
+}
+
+func (app *App) placementGroupNameHandler(w http.ResponseWriter, r *http.Request) {
+	write(w, app.PlacementGroupName)
+}
+
+func (app *App) placementPartitionNumberHandler(w http.ResponseWriter, r *http.Request) {
+	write(w, strconv.Itoa(app.PlacementPartitionNumber))
+}
+
+func (app *App) hostIDHandler(w http.ResponseWriter, r *http.Request) {
+	write(w, app.HostID)
+}
+
 func (app *App) regionHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, app.AvailabilityZone[:len(app.AvailabilityZone)-1])
+	write(w, app.region())
 }
 
 func (app *App) securityCredentialsHandler(w http.ResponseWriter, r *http.Request) {
 	write(w, app.RoleName)
 }
 
-func (app *App) networkInterfacesMacsHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, app.MacAddress+"/")
+func (app *App) servicesHandler(w http.ResponseWriter, r *http.Request) {
+	writeListing(w, r, []string{"domain", "partition"})
 }
 
-func (app *App) networkInterfacesMacsAddrHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, `device-number
-interface-id
-ipv4-associations/
-local-hostname
-local-ipv4s
-mac
-owner-id
-public-hostname
-public-ipv4s
-security-group-ids
-security-groups
-subnet-id
-subnet-ipv4-cidr-block
-vpc-id
-vpc-ipv4-cidr-block
-vpc-ipv4-cidr-blocks`)
+func (app *App) servicesDomainHandler(w http.ResponseWriter, r *http.Request) {
+	write(w, app.serviceDomain())
 }
 
-func (app *App) nimAddrDeviceNumberHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, `0`)
+func (app *App) servicesPartitionHandler(w http.ResponseWriter, r *http.Request) {
+	write(w, app.partition())
 }
 
-func (app *App) nimAddrInterfaceIdHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, `eni-asdfasdf`)
+func (app *App) productCodesHandler(w http.ResponseWriter, r *http.Request) {
+	app.optionalHandler(w, r, strings.Join(app.MarketplaceProductCodes, "\n"))
 }
 
 func (app *App) profileHandler(w http.ResponseWriter, r *http.Request) {
 	write(w, `default-hvm`)
 }
 
-func (app *App) vpcHandler(w http.ResponseWriter, r *http.Request) {
-	write(w, app.VpcID)
+// PublicKey is an SSH key pair the instance was launched with, served under public-keys/
+type PublicKey struct {
+	Name       string `yaml:"name"`
+	OpensshKey string `yaml:"openssh-key"`
+}
+
+func (app *App) publicKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if len(app.PublicKeys) == 0 {
+		app.notFoundHandler(w, r)
+		return
+	}
+	keys := make([]string, 0, len(app.PublicKeys))
+	for i, key := range app.PublicKeys {
+		keys = append(keys, fmt.Sprintf("%d=%s", i, key.Name))
+	}
+	write(w, strings.Join(keys, "\n"))
+}
+
+// publicKey looks up the key for the {index} route variable, nil if there is none
+func (app *App) publicKey(r *http.Request) *PublicKey {
+	// Only plain decimal indexes, Atoi also accepts signs
+	index := pathVar(r, "index")
+	i, err := strconv.Atoi(index)
+	if err != nil || strings.Trim(index, "0123456789") != "" || i >= len(app.PublicKeys) {
+		return nil
+	}
+	return &app.PublicKeys[i]
+}
+
+func (app *App) publicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if app.publicKey(r) == nil {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, `openssh-key`)
+}
+
+func (app *App) publicKeyOpensshKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key := app.publicKey(r)
+	if key == nil {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, key.OpensshKey)
+}
+
+func (app *App) ramdiskIdHandler(w http.ResponseWriter, r *http.Request) {
+	app.optionalHandler(w, r, app.RamdiskID)
+}
+
+func (app *App) reservationIdHandler(w http.ResponseWriter, r *http.Request) {
+	write(w, app.reservationID())
+}
+
+// reservationID returns the configured reservation ID, or one derived from the instance ID
+func (app *App) reservationID() string {
+	if app.ReservationID != "" {
+		return app.ReservationID
+	}
+	return "r-" + strings.TrimPrefix(app.InstanceID, "i-")
+}
+
+func (app *App) securityGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	if eni := app.primaryNetworkInterface(); eni != nil {
+		write(w, strings.Join(eni.SecurityGroups, "\n"))
+	}
+}
+
+// tagsHandler hides the tags/ subtree unless access to tags in instance metadata is enabled
+func (app *App) tagsHandler(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.InstanceMetadataTags {
+			app.notFoundHandler(w, r)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (app *App) tagsListHandler(w http.ResponseWriter, r *http.Request) {
+	write(w, `instance`)
+}
+
+func (app *App) tagsInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	keys := make([]string, 0, len(app.Tags))
+	for key := range app.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	write(w, strings.Join(keys, "\n"))
+}
+
+func (app *App) tagsInstanceKeyHandler(w http.ResponseWriter, r *http.Request) {
+	value, ok := app.Tags[pathVar(r, "key")]
+	if !ok {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, value)
+}
+
+// optionalHandler serves keys that only exist on some instances, 404ing when value is not set
+func (app *App) optionalHandler(w http.ResponseWriter, r *http.Request, value string) {
+	if value == "" {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, value)
 }
 
 // Credentials represent the security credentials response
@@ -496,38 +848,57 @@ type Credentials struct {
 }
 
 func (app *App) mockRoleHandler(w http.ResponseWriter, r *http.Request) {
-	// TODOLATER: round to nearest hour, to ensure test coverage passes more reliably?
-	now := time.Now().UTC()
-	expire := now.Add(6 * time.Hour)
+	credentials := app.credentials.get(app.clock.now())
+	app.metrics.credentialsServed(credentials.LastUpdated)
 	format := "2006-01-02T15:04:05Z"
 	write(w, fmt.Sprintf(`{
   "Code" : "Success",
   "LastUpdated" : "%s",
   "Type" : "AWS-HMAC",
-  "AccessKeyId" : "mock-access-key-id",
-  "SecretAccessKey" : "mock-secret-access-key",
-  "Token" : "mock-token",
+  "AccessKeyId" : "%s",
+  "SecretAccessKey" : "%s",
+  "Token" : "%s",
   "Expiration" : "%s"
-}`, now.Format(format), expire.Format(format)))
+}`, credentials.LastUpdated.Format(format), credentials.AccessKeyID, credentials.SecretAccessKey, credentials.Token,
+		credentials.Expiration.Format(format)))
 }
 
-func (app *App) roleHandler(w http.ResponseWriter, r *http.Request) {
+// assumeRole gets credentials for the role from STS, it must be called without holding app.mu
+func (app *App) assumeRole(roleArn string) (*sts.AssumeRoleOutput, error) {
 	svc := sts.New(session.New(), &aws.Config{LogLevel: aws.LogLevel(2)})
 	resp, err := svc.AssumeRole(&sts.AssumeRoleInput{
-		RoleArn:         aws.String(app.RoleArn),
+		RoleArn:         aws.String(roleArn),
 		RoleSessionName: aws.String("aws-mock-metadata"),
 	})
+	app.metrics.stsCall(err)
+	return resp, err
+}
+
+func (app *App) roleHandler(w http.ResponseWriter, r *http.Request) {
+	roleArn := app.roleArn()
+	// Called once the read lock is released, so a slow STS doesn't hold up changes through the admin API,
+	// nor every request queued behind them
+	serveUnlocked(w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.assumeRoleHandler(w, roleArn)
+	}))
+}
+
+// assumeRoleHandler serves credentials for roleArn from STS, without holding app.mu
+func (app *App) assumeRoleHandler(w http.ResponseWriter, roleArn string) {
+	resp, err := app.assumeRole(roleArn)
 	if err != nil {
 		log.Errorf("Error assuming role %+v", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	log.Debugf("STS response %+v", resp)
+	now := app.clock.now()
+	app.metrics.credentialsServed(now)
 	credentials := Credentials{
 		AccessKeyID:     *resp.Credentials.AccessKeyId,
 		Code:            "Success",
 		Expiration:      resp.Credentials.Expiration.Format("2006-01-02T15:04:05Z"),
-		LastUpdated:     time.Now().Format("2006-01-02T15:04:05Z"),
+		LastUpdated:     now.Format("2006-01-02T15:04:05Z"),
 		SecretAccessKey: *resp.Credentials.SecretAccessKey,
 		Token:           *resp.Credentials.SessionToken,
 		Type:            "AWS-HMAC",
@@ -538,22 +909,28 @@ func (app *App) roleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// roleArn returns the configured role ARN, or one for RoleName in the instance's partition and account
+func (app *App) roleArn() string {
+	if app.RoleArn != "" {
+		return app.RoleArn
+	}
+	return app.arn("iam", "role/"+app.RoleName)
+}
+
 func (app *App) notFoundHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	path := vars["path"]
-	w.WriteHeader(404)
-	write(w, `<?xml version="1.0" encoding="iso-8859-1"?>
-<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN"
-"http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
-<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
-<head>
-<title>404 - Not Found</title>
-</head>
-<body>
-<h1>404 - Not Found</h1>
-</body>
-</html>`)
-	log.Errorf("Not found " + path)
+	writeError(w, 404)
+}
+
+func (app *App) unauthorizedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, 401)
+}
+
+// optionalString maps empty strings to nil, so they are rendered as JSON null
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
 }
 
 func write(w http.ResponseWriter, s string) {
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
+
+	"go.mozilla.org/pkcs7"
 )
 
 // Custom HTTP client, that defines the redirect behavior.
@@ -34,21 +43,34 @@ func doBodyTest(t *testing.T, method string, uri string, expected_body string) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	// HACK: just check the length not the contents... for /api/token
-	// TODOLATER: adjust the input args for this function, do a switch statement or equivalent based on length or value checks
-	if expected_body == "56char" {
-		if len(string(body)) != 56 {
-			t.Errorf("%s %s : Expected 56 character response body, got a %d character body %s\n", method, uri, len(string(body)), string(body))
-		}
-	} else {
-		if string(body) != expected_body {
-			t.Errorf("%s %s : Expected\n\n%s\n\ngot\n\n%s", method, uri, expected_body, string(body))
-		}
+	if string(body) != expected_body {
+		t.Errorf("%s %s : Expected\n\n%s\n\ngot\n\n%s", method, uri, expected_body, string(body))
+	}
+}
+
+// Returns the body of a successful GET request
+func doGetBody(t *testing.T, uri string) string {
+	res, err := testHttpClient().Get(testServer.URL + uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("GET %s : Expected HTTP Status Code 200, got %d\n", uri, res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return string(body)
 }
 
 // Some URIs have 301 redirects on the real metadata service
 func doRedirectTest(t *testing.T, uri string, expected_location_uri string) {
+	doLocationTest(t, uri, fmt.Sprintf("http://169.254.169.254%s", expected_location_uri))
+}
+
+func doLocationTest(t *testing.T, uri string, expected_location string) {
 	client := testHttpClient()
 	res, err := client.Get(testServer.URL + uri)
 	if err != nil {
@@ -60,7 +82,6 @@ func doRedirectTest(t *testing.T, uri string, expected_location_uri string) {
 	if res.Header.Get("Location") == "" {
 		t.Errorf("GET %s : Expected a 'Location' HTTP response header, none found\n", uri)
 	}
-	expected_location := fmt.Sprintf("http://169.254.169.254%s", expected_location_uri)
 	if res.Header.Get("Location") != expected_location {
 		t.Errorf("GET %s : Expected 'Location' HTTP response header of %s, got %s\n", uri, expected_location, res.Header.Get("Location"))
 	}
@@ -123,6 +144,15 @@ func TestRoot(t *testing.T) {
 2016-04-19
 2016-06-30
 2016-09-02
+2018-03-28
+2018-08-17
+2018-09-24
+2019-10-01
+2020-10-27
+2021-01-03
+2021-03-23
+2021-07-15
+2022-09-24
 latest`
 
 	doBodyTest(t, "GET", "", expected_body)
@@ -147,8 +177,31 @@ func TestLatestApiToken(t *testing.T) {
 	doNotAllowedTest(t, "GET", "/latest/api/token", "OPTIONS, PUT")
 	doNotAllowedTest(t, "POST", "/latest/api/token", "OPTIONS, PUT")
 
-	// Expect a 40 character long body. Hacky but it works...
-	doBodyTest(t, "PUT", "/latest/api/token", "56char")
+	// Expect a 40 character long body, base64 encoded
+	token := doTokenRequest(t, "21600")
+	if len(token) != 56 {
+		t.Errorf("PUT /latest/api/token : Expected 56 character response body, got a %d character body %s\n", len(token), token)
+	}
+
+	req, err := http.NewRequest("GET", testServer.URL+"/latest/meta-data/instance-id", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	res, err := testHttpClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("GET /latest/meta-data/instance-id : Expected HTTP Status Code 200 with a valid token, got %d\n", res.StatusCode)
+	}
+	if ttl := res.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds"); ttl != "21600" && ttl != "21599" {
+		t.Errorf("GET /latest/meta-data/instance-id : Expected 'X-Aws-Ec2-Metadata-Token-Ttl-Seconds' of the token's remaining TTL, got %s\n", ttl)
+	}
+
+	doNotAllowedTest(t, "DELETE", "/latest/api/token", "OPTIONS, PUT")
+	doNotFoundTest(t, "PUT", "/latest/api/token/")
 }
 
 func TestLatestDynamic(t *testing.T) {
@@ -162,6 +215,7 @@ func TestLatestDynamic(t *testing.T) {
 func TestLatestDynamicInstanceIdentity(t *testing.T) {
 	expected_body := `document
 pkcs7
+rsa2048
 signature
 `
 
@@ -188,6 +242,7 @@ func TestLatestDynamicInstanceIdentityDocument(t *testing.T) {
   "version": "2010-08-31",
   "availabilityZone": "us-east-1a",
   "devpayProductCodes": null,
+  "marketplaceProductCodes": null,
   "privateIp": "10.20.30.40"
 }`
 
@@ -195,18 +250,79 @@ func TestLatestDynamicInstanceIdentityDocument(t *testing.T) {
 	doBodyTest(t, "GET", "/latest/dynamic/instance-identity/document/", expected_body)
 }
 
-func TestLatestDynamicInstanceIdentityPkcs7(t *testing.T) {
-	expected_body := `PKCS7`
+func TestInstanceIdentityDocumentFields(t *testing.T) {
+	app := NewApp()
+	app.AvailabilityZone = "us-west-2b"
+	app.Architecture = "arm64"
+	app.BillingProducts = []string{"bp-6ba54002"}
+	app.MarketplaceProductCodes = []string{"1abc2defghijklm3nopqrs4tu"}
+	app.KernelID = "aki-5c21674b"
+	app.RamdiskID = "ari-d2f38e6a"
+	app.LaunchTime = "2020-01-02T03:04:05+01:00"
+	app.IdentityDocumentVersion = "2017-09-30"
+	if err := app.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	body, err := app.instanceIdentityDocument()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document InstanceIdentityDocument
+	if err := json.Unmarshal(body, &document); err != nil {
+		t.Fatal(err)
+	}
+	if document.Architecture != "arm64" || document.Version != "2017-09-30" {
+		t.Errorf("Expected architecture arm64 and version 2017-09-30, got %s and %s", document.Architecture, document.Version)
+	}
+	if document.PendingTime != "2020-01-02T02:04:05Z" {
+		t.Errorf("Expected pendingTime 2020-01-02T02:04:05Z, got %s", document.PendingTime)
+	}
+	if len(document.BillingProducts) != 1 || document.BillingProducts[0] != "bp-6ba54002" {
+		t.Errorf("Expected billingProducts [bp-6ba54002], got %v", document.BillingProducts)
+	}
+	if len(document.MarketplaceProductCodes) != 1 || document.MarketplaceProductCodes[0] != "1abc2defghijklm3nopqrs4tu" {
+		t.Errorf("Expected marketplaceProductCodes [1abc2defghijklm3nopqrs4tu], got %v", document.MarketplaceProductCodes)
+	}
+	if document.KernelId == nil || *document.KernelId != "aki-5c21674b" || document.RamdiskId == nil || *document.RamdiskId != "ari-d2f38e6a" {
+		t.Errorf("Expected kernelId aki-5c21674b and ramdiskId ari-d2f38e6a, got %v and %v", document.KernelId, document.RamdiskId)
+	}
+}
 
-	doBodyTest(t, "GET", "/latest/dynamic/instance-identity/pkcs7", expected_body)
-	doBodyTest(t, "GET", "/latest/dynamic/instance-identity/pkcs7/", expected_body)
+func TestLatestDynamicInstanceIdentityPkcs7(t *testing.T) {
+	for _, uri := range []string{"/latest/dynamic/instance-identity/pkcs7", "/latest/dynamic/instance-identity/pkcs7/",
+		"/latest/dynamic/instance-identity/rsa2048", "/latest/dynamic/instance-identity/rsa2048/"} {
+		body := doGetBody(t, uri)
+		der, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			t.Fatalf("GET %s : Expected base64 body, got %+v", uri, err)
+		}
+		p7, err := pkcs7.Parse(der)
+		if err != nil {
+			t.Fatalf("GET %s : Expected PKCS#7 signed data, got %+v", uri, err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(testApp.identitySigner.cert)
+		if err := p7.VerifyWithChain(pool); err != nil {
+			t.Errorf("GET %s : Expected valid signature, got %+v", uri, err)
+		}
+		if string(p7.Content) != doGetBody(t, "/latest/dynamic/instance-identity/document") {
+			t.Errorf("GET %s : Expected signed content to match the document, got\n\n%s", uri, string(p7.Content))
+		}
+	}
 }
 
 func TestLatestDynamicInstanceIdentitySignature(t *testing.T) {
-	expected_body := `SIGNATURE`
-
-	doBodyTest(t, "GET", "/latest/dynamic/instance-identity/signature", expected_body)
-	doBodyTest(t, "GET", "/latest/dynamic/instance-identity/signature/", expected_body)
+	document := doGetBody(t, "/latest/dynamic/instance-identity/document")
+	digest := sha256.Sum256([]byte(document))
+	for _, uri := range []string{"/latest/dynamic/instance-identity/signature", "/latest/dynamic/instance-identity/signature/"} {
+		sig, err := base64.StdEncoding.DecodeString(doGetBody(t, uri))
+		if err != nil {
+			t.Fatalf("GET %s : Expected base64 body, got %+v", uri, err)
+		}
+		if err := rsa.VerifyPKCS1v15(&testApp.identitySigner.key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			t.Errorf("GET %s : Expected valid signature, got %+v", uri, err)
+		}
+	}
 }
 
 func TestLatestMetaData(t *testing.T) {
@@ -229,11 +345,14 @@ placement/
 profile
 public-hostname
 public-ipv4
+public-keys/
 reservation-id
 security-groups
-services/`
+services/
+tags/`
 
 	doRedirectTest(t, "/latest/meta-data", "/latest/meta-data/")
+	doRedirectTest(t, "/latest/meta-data?x=1", "/latest/meta-data/?x=1")
 	doBodyTest(t, "GET", "/latest/meta-data/", expected_body)
 }
 
@@ -260,6 +379,8 @@ func TestLatestMetaDataAmiManifestPath(t *testing.T) {
 
 func TestLatestMetaDataBlockDeviceMapping(t *testing.T) {
 	expected_body := `ami
+ebs1
+ephemeral0
 root`
 
 	doRedirectTest(t, "/latest/meta-data/block-device-mapping", "/latest/meta-data/block-device-mapping/")
@@ -280,6 +401,12 @@ func TestLatestMetaDataBlockDeviceMappingRoot(t *testing.T) {
 	doBodyTest(t, "GET", "/latest/meta-data/block-device-mapping/root/", expected_body)
 }
 
+func TestLatestMetaDataBlockDeviceMappingVolumes(t *testing.T) {
+	doBodyTest(t, "GET", "/latest/meta-data/block-device-mapping/ebs1", "/dev/xvdf")
+	doBodyTest(t, "GET", "/latest/meta-data/block-device-mapping/ephemeral0/", "/dev/sdb")
+	doNotFoundTest(t, "GET", "/latest/meta-data/block-device-mapping/swap")
+}
+
 func TestLatestMetaDataHostname(t *testing.T) {
 	expected_body := `testhostname`
 
@@ -315,7 +442,8 @@ func TestLatestMetaDataIamSecurityCredentials(t *testing.T) {
 }
 
 func TestLatestMetaDataIamSecurityCredentialsSomeInstanceProfile(t *testing.T) {
-	// TODOLATER: round to nearest hour, to ensure test coverage passes more reliably?
+	// Issued on the next request
+	testApp.credentials.reset()
 	now := time.Now().UTC()
 	expire := now.Add(6 * time.Hour)
 	format := "2006-01-02T15:04:05Z"
@@ -405,7 +533,8 @@ func TestLatestMetaDataNetworkInterfaces(t *testing.T) {
 }
 
 func TestLatestMetaDataNetworkInterfacesMacs(t *testing.T) {
-	expected_body := `00:aa:bb:cc:dd:ee/`
+	expected_body := `00:aa:bb:cc:dd:ee/
+0e:11:22:33:44:55/`
 
 	doRedirectTest(t, "/latest/meta-data/network/interfaces/macs", "/latest/meta-data/network/interfaces/macs/")
 	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/", expected_body)
@@ -447,7 +576,182 @@ func TestLatestMetaDataNIMAddrInterfaceId(t *testing.T) {
 	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/interface-id/", expected_body)
 }
 
-// TODO: coverage for the network/interfaces/macs/mac_addr/... namespaces...
+func TestLatestMetaDataNIMAddrKeys(t *testing.T) {
+	tests := map[string][2]string{
+		"device-number":          {"0", "1"},
+		"interface-id":           {"eni-asdfasdf", "eni-qwerqwer"},
+		"local-hostname":         {"testhostname", "ip-10-20-31-10.ec2.internal"},
+		"local-ipv4s":            {"10.20.30.40", "10.20.31.10\n10.20.31.11"},
+		"mac":                    {"00:aa:bb:cc:dd:ee", "0e:11:22:33:44:55"},
+		"owner-id":               {"123456789012", "123456789012"},
+		"security-group-ids":     {"sg-asdfasdf", "sg-qwerqwer"},
+		"security-groups":        {"default", "secondary"},
+		"subnet-id":              {"subnet-asdfasdf", "subnet-qwerqwer"},
+		"subnet-ipv4-cidr-block": {"10.20.30.0/24", "10.20.31.0/24"},
+		"vpc-id":                 {"vpc-asdfasdf", "vpc-asdfasdf"},
+		"vpc-ipv4-cidr-block":    {"10.20.0.0/16", "10.20.0.0/16"},
+		"vpc-ipv4-cidr-blocks":   {"10.20.0.0/16", "10.20.0.0/16\n100.64.0.0/16"},
+	}
+	for key, expected := range tests {
+		for i, mac := range []string{"00:aa:bb:cc:dd:ee", "0e:11:22:33:44:55"} {
+			doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/"+mac+"/"+key, expected[i])
+			doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/"+mac+"/"+key+"/", expected[i])
+		}
+	}
+}
+
+func TestLatestMetaDataNIMAddrPublic(t *testing.T) {
+	doRedirectTest(t, "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/ipv4-associations", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/ipv4-associations/")
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/ipv4-associations/", "54.10.20.30")
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/ipv4-associations/54.10.20.30", "10.20.30.40")
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/public-ipv4s", "54.10.20.30")
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/public-hostname", "ec2-54-10-20-30.compute-1.amazonaws.com")
+	doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/ipv4-associations/54.0.0.1")
+
+	// The secondary interface has no public IP
+	doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/public-ipv4s")
+	doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/public-hostname")
+	doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/ipv4-associations/")
+}
+
+func TestLatestMetaDataNIMAddrIpv6(t *testing.T) {
+	expected_body := `device-number
+interface-id
+ipv6s
+local-hostname
+local-ipv4s
+mac
+owner-id
+security-group-ids
+security-groups
+subnet-id
+subnet-ipv4-cidr-block
+subnet-ipv6-cidr-blocks
+vpc-id
+vpc-ipv4-cidr-block
+vpc-ipv4-cidr-blocks
+vpc-ipv6-cidr-blocks`
+
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/", expected_body)
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/ipv6s", "2600:1f18:aaaa:bb31::10")
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/subnet-ipv6-cidr-blocks", "2600:1f18:aaaa:bb31::/64")
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:11:22:33:44:55/vpc-ipv6-cidr-blocks", "2600:1f18:aaaa:bb00::/56")
+
+	// Not listed, nor served, for the IPv4 only primary interface
+	doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/ipv6s")
+	doNotFoundTest(t, "GET", "/latest/meta-data/ipv6")
+}
+
+func TestLatestMetaDataNIMAddrUnset(t *testing.T) {
+	// An interface with nothing but a MAC and interface ID
+	testApp.mu.Lock()
+	interfaces := testApp.NetworkInterfaces
+	testApp.NetworkInterfaces = append(interfaces, &NetworkInterface{Mac: "0e:99:99:99:99:99", DeviceNumber: 2, InterfaceID: "eni-unset"})
+	testApp.mu.Unlock()
+	defer func() {
+		testApp.mu.Lock()
+		testApp.NetworkInterfaces = interfaces
+		testApp.mu.Unlock()
+	}()
+
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:99:99:99:99:99/", "device-number\ninterface-id\nmac")
+	for _, key := range []string{"local-hostname", "local-ipv4s", "owner-id", "security-group-ids", "security-groups", "subnet-id",
+		"subnet-ipv4-cidr-block", "vpc-id", "vpc-ipv4-cidr-block", "vpc-ipv4-cidr-blocks"} {
+		doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/0e:99:99:99:99:99/"+key)
+	}
+}
+
+func TestLatestMetaDataNIMAddrUnknown(t *testing.T) {
+	doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:00:00:00:00:00")
+	doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:00:00:00:00:00/")
+	doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:00:00:00:00:00/device-number")
+}
+
+func TestLatestMetaDataPlacement(t *testing.T) {
+	expected_body := `availability-zone
+availability-zone-id
+region`
+
+	doRedirectTest(t, "/latest/meta-data/placement", "/latest/meta-data/placement/")
+	doBodyTest(t, "GET", "/latest/meta-data/placement/", expected_body)
+	doNotFoundTest(t, "GET", "/latest/meta-data/placement/group-name")
+	doNotFoundTest(t, "GET", "/latest/meta-data/placement/host-id")
+	doNotFoundTest(t, "GET", "/latest/meta-data/placement/partition-number")
+}
+
+func TestLatestMetaDataPlacementAvailabilityZone(t *testing.T) {
+	doBodyTest(t, "GET", "/latest/meta-data/placement/availability-zone", "us-east-1a")
+	doBodyTest(t, "GET", "/latest/meta-data/placement/availability-zone/", "us-east-1a")
+}
+
+func TestLatestMetaDataPlacementAvailabilityZoneId(t *testing.T) {
+	doBodyTest(t, "GET", "/latest/meta-data/placement/availability-zone-id", "use1-az1")
+	doBodyTest(t, "GET", "/latest/meta-data/placement/availability-zone-id/", "use1-az1")
+}
+
+func TestLatestMetaDataPlacementRegion(t *testing.T) {
+	doBodyTest(t, "GET", "/latest/meta-data/placement/region", "us-east-1")
+	doBodyTest(t, "GET", "/latest/meta-data/placement/region/", "us-east-1")
+}
+
+func TestLatestMetaDataServices(t *testing.T) {
+	expected_body := `domain
+partition`
+
+	doRedirectTest(t, "/latest/meta-data/services", "/latest/meta-data/services/")
+	doBodyTest(t, "GET", "/latest/meta-data/services/", expected_body)
+}
+
+func TestLatestMetaDataServicesDomain(t *testing.T) {
+	doBodyTest(t, "GET", "/latest/meta-data/services/domain", "amazonaws.com")
+	doBodyTest(t, "GET", "/latest/meta-data/services/domain/", "amazonaws.com")
+}
+
+func TestLatestMetaDataServicesPartition(t *testing.T) {
+	doBodyTest(t, "GET", "/latest/meta-data/services/partition", "aws")
+	doBodyTest(t, "GET", "/latest/meta-data/services/partition/", "aws")
+}
+
+func TestLatestMetaDataPublicHostname(t *testing.T) {
+	expected_body := `ec2-54-10-20-30.compute-1.amazonaws.com`
+
+	doBodyTest(t, "GET", "/latest/meta-data/public-hostname", expected_body)
+	doBodyTest(t, "GET", "/latest/meta-data/public-hostname/", expected_body)
+}
+
+func TestLatestMetaDataPublicIpv4(t *testing.T) {
+	expected_body := `54.10.20.30`
+
+	doBodyTest(t, "GET", "/latest/meta-data/public-ipv4", expected_body)
+	doBodyTest(t, "GET", "/latest/meta-data/public-ipv4/", expected_body)
+}
+
+func TestLatestMetaDataPublicKeys(t *testing.T) {
+	doRedirectTest(t, "/latest/meta-data/public-keys", "/latest/meta-data/public-keys/")
+	doBodyTest(t, "GET", "/latest/meta-data/public-keys/", "0=test-key")
+	doBodyTest(t, "GET", "/latest/meta-data/public-keys/0", "openssh-key")
+	doBodyTest(t, "GET", "/latest/meta-data/public-keys/0/", "openssh-key")
+	doBodyTest(t, "GET", "/latest/meta-data/public-keys/0/openssh-key", "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQ test-key")
+	doNotFoundTest(t, "GET", "/latest/meta-data/public-keys/1/openssh-key")
+	doNotFoundTest(t, "GET", "/latest/meta-data/public-keys/+0/openssh-key")
+}
+
+func TestLatestMetaDataReservationId(t *testing.T) {
+	doBodyTest(t, "GET", "/latest/meta-data/reservation-id", "r-asdfasdf")
+	doBodyTest(t, "GET", "/latest/meta-data/reservation-id/", "r-asdfasdf")
+}
+
+func TestLatestMetaDataSecurityGroups(t *testing.T) {
+	doBodyTest(t, "GET", "/latest/meta-data/security-groups", "default")
+	doBodyTest(t, "GET", "/latest/meta-data/security-groups/", "default")
+}
+
+func TestLatestMetaDataOptionalKeys(t *testing.T) {
+	// Only present for paravirtual and Marketplace instances
+	doNotFoundTest(t, "GET", "/latest/meta-data/kernel-id")
+	doNotFoundTest(t, "GET", "/latest/meta-data/ramdisk-id")
+	doNotFoundTest(t, "GET", "/latest/meta-data/product-codes")
+}
 
 func TestLatestMetaDataProfile(t *testing.T) {
 	expected_body := `default-hvm`
@@ -456,7 +760,93 @@ func TestLatestMetaDataProfile(t *testing.T) {
 	doBodyTest(t, "GET", "/latest/meta-data/profile/", expected_body)
 }
 
+func TestLatestMetaDataTags(t *testing.T) {
+	doRedirectTest(t, "/latest/meta-data/tags", "/latest/meta-data/tags/")
+	doBodyTest(t, "GET", "/latest/meta-data/tags/", "instance")
+	doRedirectTest(t, "/latest/meta-data/tags/instance", "/latest/meta-data/tags/instance/")
+	doBodyTest(t, "GET", "/latest/meta-data/tags/instance/", "Environment\nName")
+	doBodyTest(t, "GET", "/latest/meta-data/tags/instance/Name", "test-instance")
+	doBodyTest(t, "GET", "/latest/meta-data/tags/instance/Environment/", "test")
+	doNotFoundTest(t, "GET", "/latest/meta-data/tags/instance/Owner")
+}
+
+func TestLatestMetaDataTagsDisabled(t *testing.T) {
+	testApp.mu.Lock()
+	testApp.InstanceMetadataTags = false
+	testApp.mu.Unlock()
+	defer func() {
+		testApp.mu.Lock()
+		testApp.InstanceMetadataTags = true
+		testApp.mu.Unlock()
+	}()
+
+	doNotFoundTest(t, "GET", "/latest/meta-data/tags/")
+	doNotFoundTest(t, "GET", "/latest/meta-data/tags/instance/Name")
+	if strings.Contains(doGetBody(t, "/latest/meta-data/"), "tags/") {
+		t.Errorf("Expected tags/ not to be listed when instance metadata tags are disabled")
+	}
+}
+
 func TestLatestUserData(t *testing.T) {
 	// TODO: /latest/user-data returns a 404 if none exists... or if one exists, will return it?
 	// should we expose this in the API? not implemented right now. could be useful...
 }
+
+func TestRedirectBaseURL(t *testing.T) {
+	testApp.mu.Lock()
+	testApp.RedirectBaseURL = "http://localhost:8080/imds/"
+	testApp.mu.Unlock()
+	defer func() {
+		testApp.mu.Lock()
+		testApp.RedirectBaseURL = "http://169.254.169.254"
+		testApp.mu.Unlock()
+	}()
+
+	doLocationTest(t, "/latest/meta-data", "http://localhost:8080/imds/latest/meta-data/")
+}
+
+func TestRedirectToRequestHost(t *testing.T) {
+	testApp.mu.Lock()
+	testApp.RedirectToRequestHost = true
+	testApp.mu.Unlock()
+	defer func() {
+		testApp.mu.Lock()
+		testApp.RedirectToRequestHost = false
+		testApp.mu.Unlock()
+	}()
+
+	doLocationTest(t, "/latest/meta-data", testServer.URL+"/latest/meta-data/")
+	doLocationTest(t, "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee",
+		testServer.URL+"/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/")
+}
+
+func TestNoSchemeHostRedirects(t *testing.T) {
+	testApp.mu.Lock()
+	testApp.NoSchemeHostRedirects = true
+	testApp.mu.Unlock()
+	defer func() {
+		testApp.mu.Lock()
+		testApp.NoSchemeHostRedirects = false
+		testApp.mu.Unlock()
+	}()
+
+	doLocationTest(t, "/latest/meta-data", "/latest/meta-data/")
+}
+
+func TestNoRedirects(t *testing.T) {
+	testApp.mu.Lock()
+	testApp.NoRedirects = true
+	testApp.mu.Unlock()
+	defer func() {
+		testApp.mu.Lock()
+		testApp.NoRedirects = false
+		testApp.mu.Unlock()
+	}()
+
+	doBodyTest(t, "GET", "/latest/meta-data", doGetBody(t, "/latest/meta-data/"))
+	doBodyTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee",
+		doGetBody(t, "/latest/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/"))
+	doBodyTest(t, "GET", "/latest/meta-data/tags/instance", doGetBody(t, "/latest/meta-data/tags/instance/"))
+	doBodyTest(t, "GET", "/latest/meta-data/instance-id", "i-asdfasdf")
+	doNotFoundTest(t, "GET", "/latest/meta-data/network/interfaces/macs/00:00:00:00:00:00")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SpotInstanceAction is a scheduled spot interruption, served under spot/ once a scenario schedules one.
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/spot-instance-termination-notices.html
+type SpotInstanceAction struct {
+	Action string
+	Time   time.Time
+}
+
+func (app *App) spotHandler(w http.ResponseWriter, r *http.Request) {
+	action := app.spotInstanceAction
+	if action == nil {
+		app.notFoundHandler(w, r)
+		return
+	}
+	keys := []string{"instance-action"}
+	if action.Action == "terminate" {
+		keys = append(keys, "termination-time")
+	}
+	writeListing(w, r, keys)
+}
+
+func (app *App) spotInstanceActionHandler(w http.ResponseWriter, r *http.Request) {
+	action := app.spotInstanceAction
+	if action == nil {
+		app.notFoundHandler(w, r)
+		return
+	}
+	result, err := json.Marshal(map[string]string{
+		"action": action.Action,
+		"time":   action.Time.Format("2006-01-02T15:04:05Z"),
+	})
+	if err != nil {
+		log.Errorf("Error marshalling json %+v", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	write(w, string(result))
+}
+
+// termination-time only exists for interruptions that terminate the instance
+func (app *App) spotTerminationTimeHandler(w http.ResponseWriter, r *http.Request) {
+	action := app.spotInstanceAction
+	if action == nil || action.Action != "terminate" {
+		app.notFoundHandler(w, r)
+		return
+	}
+	write(w, action.Time.Format("2006-01-02T15:04:05Z"))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of X-aws-ec2-metadata-token-ttl-seconds, as enforced by IMDS
+const (
+	minTokenTTL = 1
+	maxTokenTTL = 21600
+)
+
+// tokenStore holds the IMDSv2 session tokens issued by PUT api/token until they expire
+type tokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time
+	// Expired tokens are pruned once the store has grown to this size
+	pruneAt int
+}
+
+// issue returns a new token valid for ttl seconds from now
+func (s *tokenStore) issue(ttl int, now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens == nil {
+		s.tokens = map[string]time.Time{}
+	}
+	if len(s.tokens) >= s.pruneAt {
+		for token, expires := range s.tokens {
+			if !now.Before(expires) {
+				delete(s.tokens, token)
+			}
+		}
+		s.pruneAt = 2*len(s.tokens) + 1024
+	}
+	// 40 character string, base64 encoded
+	token := base64.StdEncoding.EncodeToString([]byte(RandStringBytesMaskImprSrc(40)))
+	s.tokens[token] = now.Add(time.Duration(ttl) * time.Second)
+	return token
+}
+
+// ttl returns the seconds a token has left at now, or false if it was not issued or has expired
+func (s *tokenStore) ttl(token string, now time.Time) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.tokens[token]
+	if !ok {
+		return 0, false
+	}
+	remaining := expires.Sub(now)
+	if remaining <= 0 {
+		delete(s.tokens, token)
+		return 0, false
+	}
+	return int((remaining + time.Second - 1) / time.Second), true
+}
+
+// active returns how many tokens have not expired at now
+func (s *tokenStore) active(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := 0
+	for _, expires := range s.tokens {
+		if now.Before(expires) {
+			active++
+		}
+	}
+	return active
+}
+
+// checkToken rejects requests with an invalid or expired X-aws-ec2-metadata-token with a 401, and tells clients
+// how long a valid one has left. Requests without a token (IMDSv1) are served as before.
+func (app *App) checkToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-aws-ec2-metadata-token")
+		if token != "" && !strings.HasSuffix(r.URL.Path, "/api/token") {
+			ttl, ok := app.tokens.ttl(token, app.clock.now())
+			if !ok {
+				appHandler(app.unauthorizedHandler).ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", strconv.Itoa(ttl))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
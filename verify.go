@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"go.mozilla.org/pkcs7"
+)
+
+// runVerify implements the `verify` subcommand, which checks an instance identity document
+// signature (pkcs7, rsa2048 or signature) against the mock's certificate.
+func runVerify(args []string, stdout io.Writer, stderr io.Writer) int {
+	var certFile, adminURL, documentFile, signatureFile string
+	fs := pflag.NewFlagSet("verify", pflag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&certFile, "identity-cert-file", "", "PEM certificate the mock signs instance identity documents with")
+	fs.StringVar(&adminURL, "admin-url", "", "Admin API of the mock to get the certificate from, e.g. http://localhost:8081")
+	fs.StringVar(&documentFile, "document", "", "Instance identity document (optional for PKCS#7 signatures)")
+	fs.StringVar(&signatureFile, "signature", "", "Base64 encoded PKCS#7 or RSA-SHA256 signature, - for stdin")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (certFile == "") == (adminURL == "") || signatureFile == "" {
+		fmt.Fprintln(stderr, "Usage: aws-mock-metadata verify --identity-cert-file FILE|--admin-url URL --signature FILE [--document FILE]")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	var cert *x509.Certificate
+	var err error
+	if adminURL != "" {
+		cert, err = fetchCertificate(adminURL)
+	} else {
+		cert, err = readCertificateFile(certFile)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	data, err := readVerifyInput(signatureFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	signature, err := decodeBase64Signature(data)
+	if err != nil {
+		fmt.Fprintf(stderr, "error decoding signature: %+v\n", err)
+		return 2
+	}
+	var document []byte
+	if documentFile != "" {
+		if document, err = readVerifyInput(documentFile); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+
+	fmt.Fprintf(stdout, "Certificate: %s (serial %s)\n", cert.Subject, cert.SerialNumber)
+	if document != nil {
+		fmt.Fprintf(stdout, "Document SHA-256: %x (%d bytes)\n", sha256.Sum256(document), len(document))
+	}
+
+	// A PKCS#7 blob is self describing, anything else is treated as a bare RSA signature
+	if _, err := pkcs7.Parse(signature); err == nil {
+		content, err := verifyIdentityPkcs7(cert, document, signature)
+		if document != nil && len(content) > 0 && string(content) != string(document) {
+			fmt.Fprintf(stdout, "Signed content SHA-256: %x (%d bytes)\n", sha256.Sum256(content), len(content))
+		}
+		return verifyResult(stdout, "PKCS#7", err)
+	}
+	if document == nil {
+		fmt.Fprintln(stderr, "--document is required for RSA-SHA256 signatures")
+		return 2
+	}
+	return verifyResult(stdout, "RSA-SHA256", verifyIdentitySignature(cert, document, signature))
+}
+
+func verifyResult(stdout io.Writer, kind string, err error) int {
+	if err != nil {
+		fmt.Fprintf(stdout, "%s signature: INVALID (%+v)\n", kind, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s signature: OK\n", kind)
+	return 0
+}
+
+// fetchCertificate gets the certificate from the admin API of a running mock
+func fetchCertificate(adminURL string) (*x509.Certificate, error) {
+	url := strings.TrimSuffix(adminURL, "/") + "/certificate"
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error getting %s: %+v", url, err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %+v", url, err)
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("error getting %s: %s", url, res.Status)
+	}
+	return parseCertificatePEM(data, url)
+}
+
+func readVerifyInput(file string) ([]byte, error) {
+	if file == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %+v", file, err)
+	}
+	return data, nil
+}
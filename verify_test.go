@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func doVerifyTest(t *testing.T, signatureUri string, document string, expected_code int, expected_output string) {
+	paths, cleanup := writeTempFiles(t, map[string]string{
+		"cert.pem":  string(testApp.identitySigner.certificatePEM()),
+		"document":  document,
+		"signature": doGetBody(t, signatureUri),
+	})
+	defer cleanup()
+
+	var stdout, stderr bytes.Buffer
+	code := runVerify([]string{"--identity-cert-file", paths["cert.pem"], "--document", paths["document"],
+		"--signature", paths["signature"]}, &stdout, &stderr)
+	if code != expected_code {
+		t.Errorf("verify %s : Expected exit code %d, got %d\n%s%s", signatureUri, expected_code, code, stdout.String(), stderr.String())
+	}
+	if !strings.Contains(stdout.String(), expected_output) {
+		t.Errorf("verify %s : Expected output containing %q, got\n\n%s", signatureUri, expected_output, stdout.String())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	document := doGetBody(t, "/latest/dynamic/instance-identity/document")
+
+	doVerifyTest(t, "/latest/dynamic/instance-identity/pkcs7", document, 0, "PKCS#7 signature: OK")
+	doVerifyTest(t, "/latest/dynamic/instance-identity/rsa2048", document, 0, "PKCS#7 signature: OK")
+	doVerifyTest(t, "/latest/dynamic/instance-identity/signature", document, 0, "RSA-SHA256 signature: OK")
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	document := strings.Replace(doGetBody(t, "/latest/dynamic/instance-identity/document"), "i-asdfasdf", "i-tampered", 1)
+
+	doVerifyTest(t, "/latest/dynamic/instance-identity/pkcs7", document, 1, "PKCS#7 signature: INVALID")
+	doVerifyTest(t, "/latest/dynamic/instance-identity/signature", document, 1, "RSA-SHA256 signature: INVALID")
+}
+
+func TestVerifyAdminURL(t *testing.T) {
+	paths, cleanup := writeTempFiles(t, map[string]string{
+		"document":  doGetBody(t, "/latest/dynamic/instance-identity/document"),
+		"signature": doGetBody(t, "/latest/dynamic/instance-identity/signature"),
+	})
+	defer cleanup()
+
+	var stdout, stderr bytes.Buffer
+	code := runVerify([]string{"--admin-url", testAdminServer.URL, "--document", paths["document"],
+		"--signature", paths["signature"]}, &stdout, &stderr)
+	if code != 0 || !strings.Contains(stdout.String(), "RSA-SHA256 signature: OK") {
+		t.Errorf("verify --admin-url : Expected a valid signature, got exit code %d\n%s%s", code, stdout.String(), stderr.String())
+	}
+}
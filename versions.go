@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The API version each key was introduced in, keyed by its path below the version prefix.
+// Keys that are not listed share their parent's version, top level ones default to 1.0.
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instancedata-data-categories.html
+var keyVersions = map[string]string{
+	"dynamic":                                  "2009-04-04",
+	"meta-data/ami-launch-index":               "2007-01-19",
+	"meta-data/block-device-mapping":           "2007-12-15",
+	"meta-data/iam":                            "2012-01-12",
+	"meta-data/instance-action":                "2008-09-01",
+	"meta-data/instance-type":                  "2007-08-29",
+	"meta-data/ipv6":                           "2021-01-03",
+	"meta-data/kernel-id":                      "2008-02-01",
+	"meta-data/local-hostname":                 "2007-01-19",
+	"meta-data/mac":                            "2011-01-01",
+	"meta-data/metrics":                        "2011-05-01",
+	"meta-data/network":                        "2011-01-01",
+	"meta-data/placement":                      "2008-02-01",
+	"meta-data/placement/availability-zone-id": "2019-10-01",
+	"meta-data/placement/group-name":           "2020-08-24",
+	"meta-data/placement/host-id":              "2020-08-24",
+	"meta-data/placement/partition-number":     "2020-08-24",
+	"meta-data/placement/region":               "2020-08-24",
+	"meta-data/product-codes":                  "2007-03-01",
+	"meta-data/public-hostname":                "2007-01-19",
+	"meta-data/public-ipv4":                    "2007-01-19",
+	"meta-data/ramdisk-id":                     "2007-10-10",
+	"meta-data/services":                       "2014-02-25",
+	"meta-data/services/partition":             "2015-10-20",
+	"meta-data/spot":                           "2014-11-05",
+	"meta-data/spot/instance-action":           "2016-11-15",
+	"meta-data/tags":                           "2021-03-23",
+	// * matches the MAC address
+	"meta-data/network/interfaces/macs/*/ipv6s":                   "2016-06-30",
+	"meta-data/network/interfaces/macs/*/subnet-ipv6-cidr-blocks": "2016-06-30",
+	"meta-data/network/interfaces/macs/*/vpc-ipv4-cidr-blocks":    "2016-06-30",
+	"meta-data/network/interfaces/macs/*/vpc-ipv6-cidr-blocks":    "2016-06-30",
+}
+
+const macsPath = "meta-data/network/interfaces/macs"
+
+// keyVersion returns the API version the key at path (below the version prefix) was introduced in
+func keyVersion(path string) string {
+	path = strings.Trim(path, "/")
+	if strings.HasPrefix(path, macsPath+"/") {
+		rest := path[len(macsPath)+1:]
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			path = macsPath + "/*" + rest[i:]
+		}
+	}
+	for {
+		if version, ok := keyVersions[path]; ok {
+			return version
+		}
+		i := strings.LastIndexByte(path, '/')
+		if i < 0 {
+			return "1.0"
+		}
+		path = path[:i]
+	}
+}
+
+// versionIncludes reports whether API version has the keys introduced in since. Versions are
+// 1.0, then dates which compare as strings, then latest.
+func versionIncludes(version string, since string) bool {
+	switch {
+	case version == "latest" || since == "1.0":
+		return true
+	case version == "1.0":
+		return false
+	}
+	return version >= since
+}
+
+// splitVersionPath splits a request path into the API version and the path below it
+func splitVersionPath(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// writeListing writes a directory listing, leaving out the keys the requested API version does not have
+func writeListing(w http.ResponseWriter, r *http.Request, keys []string) {
+	version, dir := splitVersionPath(r.URL.Path)
+	listed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if versionIncludes(version, keyVersion(strings.TrimSuffix(dir, "/")+"/"+key)) {
+			listed = append(listed, key)
+		}
+	}
+	write(w, strings.Join(listed, "\n"))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVersionIncludes(t *testing.T) {
+	tests := []struct {
+		version  string
+		since    string
+		expected bool
+	}{
+		{"1.0", "1.0", true},
+		{"1.0", "2007-01-19", false},
+		{"2008-02-01", "2007-12-15", true},
+		{"2008-02-01", "2008-02-01", true},
+		{"2008-02-01", "2012-01-12", false},
+		{"latest", "2021-03-23", true},
+	}
+	for _, test := range tests {
+		if got := versionIncludes(test.version, test.since); got != test.expected {
+			t.Errorf("versionIncludes(%q, %q) : Expected %v, got %v", test.version, test.since, test.expected, got)
+		}
+	}
+}
+
+func TestKeyVersion(t *testing.T) {
+	tests := map[string]string{
+		"meta-data/ami-id":                                          "1.0",
+		"meta-data/iam/security-credentials/":                       "2012-01-12",
+		"meta-data/placement/availability-zone":                     "2008-02-01",
+		"meta-data/placement/region":                                "2020-08-24",
+		"meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/":      "2011-01-01",
+		"meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/ipv6s": "2016-06-30",
+		"dynamic/instance-identity/document":                        "2009-04-04",
+	}
+	for path, expected := range tests {
+		if got := keyVersion(path); got != expected {
+			t.Errorf("keyVersion(%q) : Expected %s, got %s", path, expected, got)
+		}
+	}
+}
+
+func TestVersionedListings(t *testing.T) {
+	doBodyTest(t, "GET", "/2008-02-01/", `meta-data
+user-data`)
+	doBodyTest(t, "GET", "/2008-02-01/meta-data/placement/", "availability-zone")
+
+	body := doGetBody(t, "/2008-02-01/meta-data/")
+	for _, key := range []string{"iam/", "mac", "network/", "services/", "tags/"} {
+		if strings.Contains(body, key+"\n") || strings.HasSuffix(body, key) {
+			t.Errorf("GET /2008-02-01/meta-data/ : Expected no %s, got\n\n%s", key, body)
+		}
+	}
+	if !strings.Contains(body, "block-device-mapping/") {
+		t.Errorf("GET /2008-02-01/meta-data/ : Expected block-device-mapping/, got\n\n%s", body)
+	}
+
+	body = doGetBody(t, "/2011-01-01/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/")
+	if strings.Contains(body, "vpc-ipv4-cidr-blocks") {
+		t.Errorf("GET /2011-01-01/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/ : Expected no vpc-ipv4-cidr-blocks, got\n\n%s", body)
+	}
+}
+
+func TestVersionedKeys(t *testing.T) {
+	doNotFoundTest(t, "GET", "/2008-02-01/meta-data/iam/info")
+	doNotFoundTest(t, "GET", "/2008-02-01/dynamic/instance-identity/document")
+	doNotFoundTest(t, "GET", "/2019-10-01/meta-data/placement/region")
+	doNotFoundTest(t, "GET", "/2016-04-19/meta-data/network/interfaces/macs/00:aa:bb:cc:dd:ee/ipv6s")
+	doBodyTest(t, "GET", "/1.0/meta-data/instance-id", "i-asdfasdf")
+	doBodyTest(t, "GET", "/2012-01-12/meta-data/iam/info", doGetBody(t, "/latest/meta-data/iam/info"))
+}